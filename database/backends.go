@@ -0,0 +1,85 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+)
+
+// backends are the storage engines compiled in this binary, by name.
+// each one is in a file with its own build tag, and more than one
+// can be built in at the same time.
+var (
+	backendsmu     sync.Mutex
+	backends       = make(map[string]func(path string) levelup.DB)
+	defaultBackend string
+)
+
+// RegisterBackend makes a storage engine available to OpenBackend and Migrate.
+// the first one registered is the one used by Open.
+func RegisterBackend(name string, open func(path string) levelup.DB) {
+	backendsmu.Lock()
+	defer backendsmu.Unlock()
+	backends[name] = open
+	if defaultBackend == "" {
+		defaultBackend = name
+	}
+}
+
+// Backends returns the names of all registered storage engines.
+func Backends() []string {
+	backendsmu.Lock()
+	defer backendsmu.Unlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func openStore(backend, path string) (levelup.DB, error) {
+	backendsmu.Lock()
+	open, ok := backends[backend]
+	backendsmu.Unlock()
+	if !ok {
+		return nil, errors.New("unknown backend: " + backend +
+			" (available: " + strings.Join(Backends(), ", ") + ")")
+	}
+	return open(path), nil
+}
+
+// ParseLocation splits a "<backend>:<path>" location, neither of which
+// can be empty.
+func ParseLocation(location string) (backend, path string, err error) {
+	parts := strings.SplitN(location, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("location should be <backend>:<path>: " + location)
+	}
+	return parts[0], parts[1], nil
+}
+
+// OpenBackend opens the database at dbpath with the named storage engine.
+// databases in an older format must be upgraded first, with Upgrade.
+func OpenBackend(backend, dbpath string) (*SummaDB, error) {
+	db, err := openStore(backend, dbpath)
+	if err != nil {
+		return nil, err
+	}
+	local, err := openStore(backend, dbpath+"_local")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	summadb, err := newSummaDB(slu.StringDB(db), slu.StringDB(local))
+	if err != nil {
+		db.Close()
+		local.Close()
+		return nil, err
+	}
+	return summadb, nil
+}
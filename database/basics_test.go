@@ -20,7 +20,7 @@ type DatabaseSuite struct{}
 var _ = Suite(&DatabaseSuite{})
 
 func (s *DatabaseSuite) TestBasics(c *C) {
-	db := Open("/tmp/summadb-test-basics")
+	db := OpenMemory()
 	defer db.Erase()
 
 	// insert a tree
@@ -155,7 +155,7 @@ func (s *DatabaseSuite) TestBasics(c *C) {
 }
 
 func (s *DatabaseSuite) TestMerge(c *C) {
-	db := Open("/tmp/summadb-test-merge")
+	db := OpenMemory()
 	defer db.Erase()
 
 	// insert things by merging
@@ -236,7 +236,7 @@ func (s *DatabaseSuite) TestMerge(c *C) {
 }
 
 func (s *DatabaseSuite) TestQuery(c *C) {
-	db := Open("/tmp/summadb-test-query")
+	db := OpenMemory()
 	defer db.Erase()
 
 	// insert a tree
@@ -339,7 +339,7 @@ end
 }
 
 func (s *DatabaseSuite) TestSelect(c *C) {
-	db := Open("/tmp/summadb-test-select")
+	db := OpenMemory()
 	defer db.Erase()
 
 	// fetch something
@@ -414,3 +414,258 @@ func (s *DatabaseSuite) TestSelect(c *C) {
         }
     }`)
 }
+
+func (s *DatabaseSuite) TestArrays(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	err = db.Set(types.Path{"post"}, types.TreeFromJSON(`{
+      "title": "hello",
+      "tags": ["a", "b", {"name": "c"}]
+    }`))
+	c.Assert(err, IsNil)
+
+	treeread, err := db.Read(types.Path{"post", "tags"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Array, Equals, true)
+	elements := treeread.Elements()
+	c.Assert(elements, HasLen, 3)
+	c.Assert(elements[1].Leaf, DeepEquals, types.StringLeaf("b"))
+	c.Assert(elements[2].Branches["name"].Leaf, DeepEquals, types.StringLeaf("c"))
+
+	// update a single element
+	err = db.Set(types.Path{"post", "tags", "1"}, types.Tree{
+		Rev:  elements[1].Rev,
+		Leaf: types.StringLeaf("x"),
+	})
+	c.Assert(err, IsNil)
+
+	treeread, err = db.Read(types.Path{"post"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["tags"].Array, Equals, true)
+	c.Assert(treeread.Branches["tags"].Elements()[1].Leaf, DeepEquals, types.StringLeaf("x"))
+	c.Assert(treeread.Branches["title"].Array, Equals, false)
+
+	// delete an element
+	err = db.Delete(types.Path{"post", "tags", "0"}, treeread.Branches["tags"].Branches["0"].Rev)
+	c.Assert(err, IsNil)
+	treeread, err = db.Read(types.Path{"post", "tags"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Elements(), HasLen, 2)
+
+	// replacing the array with something else unmarks it
+	err = db.Set(types.Path{"post", "tags"}, types.Tree{
+		Rev:  treeread.Rev,
+		Leaf: types.StringLeaf("no tags"),
+	})
+	c.Assert(err, IsNil)
+	treeread, err = db.Read(types.Path{"post", "tags"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Array, Equals, false)
+
+	// merging elements keeps an array, merging an object unmarks it
+	err = db.Set(types.Path{"post", "links"}, types.TreeFromJSON(`["a", "b"]`))
+	c.Assert(err, IsNil)
+	rev, _ := db.Rev(types.Path{"post", "links"})
+	err = db.Merge(types.Path{"post", "links"}, types.Tree{Rev: rev, Branches: types.Branches{
+		"0": &types.Tree{Leaf: types.StringLeaf("y")},
+	}})
+	c.Assert(err, IsNil)
+	treeread, err = db.Read(types.Path{"post", "links"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Array, Equals, true)
+	c.Assert(treeread.Elements()[0].Leaf, DeepEquals, types.StringLeaf("y"))
+
+	err = db.Merge(types.Path{"post", "links"}, types.Tree{Rev: treeread.Rev, Branches: types.Branches{
+		"01": &types.Tree{Leaf: types.StringLeaf("z")},
+	}})
+	c.Assert(err, IsNil)
+	treeread, err = db.Read(types.Path{"post", "links"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Array, Equals, false)
+	treeread.Rev = ""
+	_, err = treeread.MarshalJSON()
+	c.Assert(err, IsNil)
+}
+
+func (s *DatabaseSuite) TestEscapedKeys(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	url := "https://example.com/posts/1"
+	err = db.Set(types.PathFromKeys("links", url), types.TreeFromJSON(`{"_id": "x", " title ": "hello", "100%": "full"}`))
+	c.Assert(err, IsNil)
+	err = db.Set(types.PathFromKeys("links", "https://example.com/posts"), types.Tree{Leaf: types.StringLeaf("list")})
+	c.Assert(err, IsNil)
+
+	treeread, err := db.Read(types.Path{"links"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2)
+	doc := treeread.Branches[types.EscapeKey(url)]
+	c.Assert(doc.Branches[types.EscapeKey("_id")].Leaf, DeepEquals, types.StringLeaf("x"))
+	c.Assert(doc.Branches[types.EscapeKey(" title ")].Leaf, DeepEquals, types.StringLeaf("hello"))
+	c.Assert(doc.Branches["100%25"].Leaf, DeepEquals, types.StringLeaf("full"))
+	c.Assert(doc.Rev, StartsWith, "1-")
+
+	treeread, err = db.Read(types.ParsePath("links/" + types.EscapeKey(url) + "/%5Fid"))
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Leaf, DeepEquals, types.StringLeaf("x"))
+
+	// views see raw keys and the keys they emit are escaped once
+	rev, _ := db.Rev(types.Path{"links"})
+	err = db.Merge(types.Path{"links"}, types.Tree{
+		Rev: rev,
+		Map: `if doc[" title "] then emit("by-title", doc[" title "]._val, _key, doc["100%"]._val) end`,
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"links", "!map", "by-title", "hello", types.EscapeKey(url)})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Leaf, DeepEquals, types.StringLeaf("full"))
+}
+
+func (s *DatabaseSuite) TestStats(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	c.Assert(db.Set(types.Path{"tenants"}, types.Tree{
+		Branches: types.Branches{
+			"small": &types.Tree{Leaf: types.StringLeaf("x")},
+			"large": &types.Tree{
+				Map: `emit('values', _key, doc._val)`,
+				Branches: types.Branches{
+					"a": &types.Tree{Leaf: types.StringLeaf("a long string, much longer than x")},
+					"b": &types.Tree{Branches: types.Branches{
+						"c": &types.Tree{Leaf: types.NumberLeaf(12)},
+					}},
+					"d": &types.Tree{Leaf: types.BoolLeaf(true)},
+				},
+			},
+		},
+	}), IsNil)
+	rev, _ := db.Rev(types.Path{"tenants", "large", "d"})
+	c.Assert(db.Delete(types.Path{"tenants", "large", "d"}, rev), IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	stats, err := db.Stats(types.Path{"tenants"}, 1)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Path, Equals, "tenants")
+	c.Assert(stats.Nodes, Equals, 7) // tenants, small, large, a, b, c and d
+	c.Assert(stats.Leaves, Equals, 3)
+	c.Assert(stats.Tombstones, Equals, 1)
+	c.Assert(stats.DeepestPath, Equals, "tenants/large/b/c")
+	c.Assert(stats.ValueBytes > 0, Equals, true)
+	c.Assert(stats.ViewBytes > 0, Equals, true)
+	c.Assert(stats.Largest, HasLen, 1)
+	c.Assert(stats.Largest[0].Key, Equals, "large")
+	c.Assert(stats.Largest[0].Nodes, Equals, 5)
+	c.Assert(stats.Largest[0].Bytes > stats.ViewBytes, Equals, true)
+
+	// the view at the path itself is one of its children
+	stats, err = db.Stats(types.Path{"tenants", "large"}, 10)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Nodes, Equals, 5)
+	c.Assert(stats.Largest, HasLen, 4)
+	var viewbytes int64
+	for _, child := range stats.Largest {
+		if child.Key == "!map" {
+			viewbytes = child.Bytes
+		}
+	}
+	c.Assert(viewbytes, Equals, stats.ViewBytes)
+
+	stats, err = db.Stats(types.Path{"nothing"}, 10)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Nodes, Equals, 0)
+	c.Assert(stats.Largest, HasLen, 0)
+
+	_, err = db.Stats(types.Path{"tenants"}, -1)
+	c.Assert(err, ErrorMatches, "cannot list a negative number of children: -1")
+	stats, err = db.Stats(types.Path{"tenants"}, 0)
+	c.Assert(err, IsNil)
+	c.Assert(stats.Largest, HasLen, 0)
+}
+
+func (s *DatabaseSuite) TestMove(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	c.Assert(db.Set(types.Path{"pantry"}, types.Tree{
+		Map: `if doc.banana then emit('bananas', _key, doc.banana._val) end`,
+		Branches: types.Branches{
+			"fruits": &types.Tree{
+				Map: `emit('by-color', doc._val, 1)`,
+				Branches: types.Branches{
+					"banana": &types.Tree{Leaf: types.StringLeaf("yellow")},
+					"grape":  &types.Tree{Leaf: types.StringLeaf("purple")},
+				},
+			},
+		},
+	}), IsNil)
+	c.Assert(db.Set(types.Path{"cellar"}, types.Tree{
+		Map: `if doc.banana then emit('bananas', _key, doc.banana._val) end`,
+		Branches: types.Branches{
+			"wine": &types.Tree{Leaf: types.StringLeaf("red")},
+		},
+	}), IsNil)
+	time.Sleep(time.Millisecond * 200)
+	rev, _ := db.Rev(types.Path{"pantry", "fruits", "grape"})
+	c.Assert(db.Delete(types.Path{"pantry", "fruits", "grape"}, rev), IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	rev, _ = db.Rev(types.Path{"pantry", "fruits"})
+	c.Assert(rev, StartsWith, "2-")
+	c.Assert(db.Move(types.Path{"pantry", "fruits"}, types.Path{"cellar", "fruits"}, "1-x"), ErrorMatches, "mismatched revs.*")
+	c.Assert(db.Move(types.Path{"pantry", "fruits"}, types.Path{"pantry", "fruits", "dried"}, rev), ErrorMatches, "cannot move a path into itself.*")
+	c.Assert(db.Move(types.Path{"pantry", "fruits"}, types.Path{"cellar", "wine"}, rev), ErrorMatches, "cannot move to existing path.*")
+	c.Assert(db.Move(types.Path{"pantry", "fruits"}, types.Path{"cellar", "fruits"}, rev), IsNil)
+
+	// the rows of the moved view are there right away
+	rows, err := db.Read(types.Path{"cellar", "fruits", "!map", "by-color"})
+	c.Assert(err, IsNil)
+	c.Assert(rows.Branches, HasLen, 1)
+	c.Assert(rows.Branches["yellow"].Leaf, DeepEquals, types.NumberLeaf(1))
+	time.Sleep(time.Millisecond * 200)
+
+	// the source is deleted
+	treeread, err := db.Read(types.Path{"pantry"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Rev, StartsWith, "3-")
+	c.Assert(treeread.Branches["fruits"].Rev, StartsWith, "3-")
+	c.Assert(treeread.Branches["fruits"].Deleted, Equals, true)
+	c.Assert(treeread.Branches["fruits"].Branches["banana"].Deleted, Equals, true)
+	c.Assert(treeread.Branches["fruits"].Branches["banana"].Leaf, DeepEquals, types.Leaf{})
+	rows, err = db.Read(types.Path{"pantry", "fruits", "!map", "by-color"})
+	c.Assert(err, IsNil)
+	c.Assert(rows.Branches, HasLen, 0)
+	c.Assert(db.Move(types.Path{"pantry", "fruits"}, types.Path{"cellar", "veggies"}, treeread.Branches["fruits"].Rev), ErrorMatches, "cannot move deleted path.*")
+
+	// the destination has everything but what was already deleted, with new revs
+	treeread, err = db.Read(types.Path{"cellar"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Rev, StartsWith, "2-")
+	c.Assert(treeread.Branches["fruits"].Rev, StartsWith, "1-")
+	c.Assert(treeread.Branches["fruits"].Map, Equals, `emit('by-color', doc._val, 1)`)
+	c.Assert(treeread.Branches["fruits"].Branches["banana"].Rev, StartsWith, "1-")
+	c.Assert(treeread.Branches["fruits"].Branches["banana"].Leaf, DeepEquals, types.StringLeaf("yellow"))
+	_, ok := treeread.Branches["fruits"].Branches["grape"]
+	c.Assert(ok, Equals, false)
+
+	// views at the old and new ancestors are updated
+	rows, err = db.Read(types.Path{"pantry", "!map", "bananas"})
+	c.Assert(err, IsNil)
+	c.Assert(rows.Branches, HasLen, 0)
+	rows, err = db.Read(types.Path{"cellar", "!map", "bananas"})
+	c.Assert(err, IsNil)
+	c.Assert(rows.Branches, HasLen, 1)
+	c.Assert(rows.Branches["fruits"].Leaf, DeepEquals, types.StringLeaf("yellow"))
+
+	// and the moved view is mapped again at its new place
+	status, err := db.ViewStatus(types.Path{"cellar", "fruits"})
+	c.Assert(err, IsNil)
+	c.Assert(status.Rows, Equals, 1)
+	status, err = db.ViewStatus(types.Path{"pantry", "fruits"})
+	c.Assert(err, IsNil)
+	c.Assert(status.Rows, Equals, 0)
+}
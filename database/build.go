@@ -0,0 +1,458 @@
+package database
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+	"github.com/summadb/summadb/views"
+)
+
+// BuildProgress reports how far the background build of a view has gone.
+type BuildProgress struct {
+	Total   int       `json:"total"` // documents to map, including the ones changed during the build
+	Done    int       `json:"done"`
+	Started time.Time `json:"started"`
+}
+
+// build is a rebuild of all the rows of a view after its map or reduce
+// function changed. the new rows are staged in the local store, under
+// "building:<path>//<id>//<docid>", while the old ones keep being served,
+// then all are swapped at once (see commitSwap).
+type build struct {
+	id   string
+	mapf string
+
+	mu       sync.Mutex
+	progress BuildProgress
+	dirty    map[string]bool // documents modified while the build was running
+}
+
+type stagedRow struct {
+	Path  types.Path `json:"path"`
+	Value types.Tree `json:"value"`
+}
+
+// BuildProgress returns the progress of the background build of the view
+// at the given path, if there is one running.
+func (db *SummaDB) BuildProgress(viewpath types.Path) (progress BuildProgress, building bool) {
+	db.buildsmu.Lock()
+	b, building := db.builds[viewpath.Join()]
+	db.buildsmu.Unlock()
+	if !building {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.progress, true
+}
+
+// rebuildView maps all documents of the view at p with mapf into a staging area
+// and replaces the current rows (and the reduced value) with them at once.
+// a rebuild started later for the same path supersedes this one.
+func (db *SummaDB) rebuildView(mapf string, p types.Path) {
+	b := &build{
+		id:       strconv.FormatInt(time.Now().UnixNano(), 36),
+		mapf:     mapf,
+		progress: BuildProgress{Started: time.Now().UTC()},
+		dirty:    make(map[string]bool),
+	}
+	db.buildsmu.Lock()
+	db.builds[p.Join()] = b
+	db.buildsmu.Unlock()
+	defer db.discardStagedRows(p, b)
+
+	tree, err := db.Read(p)
+	if err != nil {
+		log.Error("failed to fetch parent tree on rebuildView.",
+			"err", err,
+			"path", p)
+		db.abandonBuild(p, b)
+		return
+	}
+	defer db.dropPending(p, b)
+
+	docs := documentsAt(tree, types.Path{}, db.mapDepth(p))
+
+	b.mu.Lock()
+	b.progress.Total += len(docs)
+	b.mu.Unlock()
+	db.addPending(p, len(docs))
+
+	for docid, doc := range docs {
+		if !db.isCurrentBuild(p, b) {
+			return
+		}
+		db.stageDocument(p, b, docid, *doc)
+	}
+
+	for {
+		// map again the documents changed since they were staged
+		for {
+			b.mu.Lock()
+			dirty := b.dirty
+			b.dirty = make(map[string]bool)
+			b.mu.Unlock()
+			if len(dirty) == 0 {
+				break
+			}
+
+			for docid := range dirty {
+				if !db.isCurrentBuild(p, b) {
+					return
+				}
+				doc, err := db.Read(docPath(p, docid))
+				if err != nil {
+					log.Error("failed to read document changed during rebuildView.",
+						"err", err,
+						"path", p,
+						"docid", docid)
+					b.mu.Lock()
+					b.progress.Done++
+					b.mu.Unlock()
+					db.addPending(p, -1)
+					continue
+				}
+				db.stageDocument(p, b, docid, doc)
+			}
+		}
+
+		// the new rows and reduced value are computed without holding the
+		// lock, as the reduce function may take a while. it is only taken
+		// to commit them, if no document was changed in the meantime.
+		s, err := db.prepareSwap(p, b)
+		if err != nil {
+			log.Error("failed to swap rebuilt view.",
+				"err", err,
+				"path", p)
+			db.abandonBuild(p, b)
+			return
+		}
+
+		db.buildsmu.Lock()
+		if db.builds[p.Join()] != b {
+			db.buildsmu.Unlock()
+			return
+		}
+		b.mu.Lock()
+		changed := len(b.dirty) > 0
+		b.mu.Unlock()
+		if changed {
+			db.buildsmu.Unlock()
+			continue
+		}
+
+		err = db.commitSwap(p, s)
+		if err != nil {
+			log.Error("failed to swap rebuilt view.",
+				"err", err,
+				"path", p)
+		}
+		delete(db.builds, p.Join())
+		db.buildsmu.Unlock()
+
+		// views defined on the rows are rebuilt after the swap
+		for viewpath, mapf := range s.downstream {
+			go db.rebuildView(mapf, types.ParsePath(viewpath))
+		}
+		return
+	}
+}
+
+// markDirty tells the build running for the view at p, if any, that docid
+// has changed and must be mapped again. it returns false when there's
+// no build running.
+func (db *SummaDB) markDirty(p types.Path, docid string) bool {
+	db.buildsmu.Lock()
+	defer db.buildsmu.Unlock()
+
+	b, building := db.builds[p.Join()]
+	if !building {
+		return false
+	}
+
+	b.mu.Lock()
+	if !b.dirty[docid] {
+		b.dirty[docid] = true
+		b.progress.Total++
+		db.addPending(p, 1)
+	}
+	b.mu.Unlock()
+	return true
+}
+
+func (db *SummaDB) isCurrentBuild(p types.Path, b *build) bool {
+	db.buildsmu.Lock()
+	defer db.buildsmu.Unlock()
+	return db.builds[p.Join()] == b
+}
+
+func (db *SummaDB) abandonBuild(p types.Path, b *build) {
+	db.buildsmu.Lock()
+	defer db.buildsmu.Unlock()
+	if db.builds[p.Join()] == b {
+		delete(db.builds, p.Join())
+	}
+}
+
+// dropPending forgets the documents the build didn't get to map
+// because it was superseded.
+func (db *SummaDB) dropPending(p types.Path, b *build) {
+	b.mu.Lock()
+	remaining := b.progress.Total - b.progress.Done
+	b.mu.Unlock()
+	db.addPending(p, -remaining)
+}
+
+func stagingPrefix(p types.Path, b *build) string {
+	return "building:" + p.Join() + "//" + b.id + "//"
+}
+
+// stageDocument maps a document and stores the rows it emitted
+// in the staging area of the build.
+func (db *SummaDB) stageDocument(p types.Path, b *build, docid string, doc types.Tree) {
+	defer func() {
+		b.mu.Lock()
+		b.progress.Done++
+		b.mu.Unlock()
+		db.addPending(p, -1)
+	}()
+
+	var emittedrows []types.EmittedRow
+	if b.mapf == "" {
+		// the map function was deleted, so the view will be empty.
+		db.clearViewError(p, "map", docid)
+		db.updateDependencies(p, docid, nil)
+	} else {
+		emittedrows = db.runMap(p, b.mapf, doc, docid)
+	}
+
+	key := stagingPrefix(p, b) + docid
+	if len(emittedrows) == 0 {
+		err := db.local.Del(key)
+		if err != nil {
+			log.Error("failed to unstage document.",
+				"err", err,
+				"key", key)
+		}
+		return
+	}
+
+	staged := make([]stagedRow, len(emittedrows))
+	for i, row := range emittedrows {
+		staged[i] = stagedRow{row.RelativePath, row.Value}
+	}
+	value, _ := json.Marshal(staged)
+	err := db.local.Put(key, string(value))
+	if err != nil {
+		log.Error("failed to stage emitted rows.",
+			"err", err,
+			"key", key)
+	}
+}
+
+// swap is what replaces the rows of a view, and its reduced value,
+// when its build is done.
+type swap struct {
+	mapf       string
+	ops        []levelup.Operation // the rows and the reduced value
+	localops   []levelup.Operation // the rows emitted by each document
+	reducedeps []types.Path        // the libraries used by the reduce function
+	downstream map[string]string   // views defined on the rows, by their map functions
+}
+
+func swappingKey(p types.Path) string { return "swapping:" + p.Join() }
+
+// prepareSwap computes the swap of all the rows of the view at p, and its
+// reduced value, with the ones staged by the build.
+func (db *SummaDB) prepareSwap(p types.Path, b *build) (s swap, err error) {
+	s.mapf = b.mapf
+	s.downstream = make(map[string]string)
+
+	// remove all current rows, but not the views defined on them
+	// (those are rebuilt after the swap)
+	rowspath := p.Child("!map")
+	current := db.ReadRange(&slu.RangeOpts{
+		Start: rowspath.Join() + "/",
+		End:   rowspath.Join() + rangeEnd,
+	})
+	for ; current.Valid(); current.Next() {
+		if err = current.Error(); err != nil {
+			current.Release()
+			return
+		}
+
+		relpath := types.ParsePath(current.Key()).RelativeTo(rowspath)
+		if isSpecialPath(relpath.Join()) {
+			if relpath.Last() == "!map" && !isSpecialPath(relpath.Parent().Join()) {
+				s.downstream[append(rowspath.Copy(), relpath.Parent()...).Join()] = current.Value()
+			}
+			continue
+		}
+		s.ops = append(s.ops, slu.Del(current.Key()))
+	}
+	current.Release()
+
+	// add all staged rows, keeping track of which document emitted them
+	type docrow struct {
+		docid string
+		row   types.EmittedRow
+	}
+	var rows []docrow
+	mapped := make(map[string][]string)
+
+	prefix := stagingPrefix(p, b)
+	iter := db.local.ReadRange(&slu.RangeOpts{
+		Start: prefix,
+		End:   prefix + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			iter.Release()
+			return
+		}
+
+		docid := strings.TrimPrefix(iter.Key(), prefix)
+		var staged []stagedRow
+		if err = json.Unmarshal([]byte(iter.Value()), &staged); err != nil {
+			iter.Release()
+			return
+		}
+		for _, row := range staged {
+			s.ops = append(s.ops, emittedRowInsertions(p, row.Path, row.Value)...)
+			rows = append(rows, docrow{docid, types.EmittedRow{RelativePath: row.Path, Value: row.Value}})
+			mapped[docid] = append(mapped[docid], row.Path.Join())
+		}
+	}
+	iter.Release()
+
+	// compute the reduced value from scratch, taking note of the libraries it uses
+	rec := &recorder{db: db}
+	reducepath := p.Child("!reduce")
+	reducef, _ := db.Get(reducepath.Join())
+	oldvalue, err := db.Read(reducepath)
+	if err != nil && err != levelup.NotFound {
+		return
+	}
+	err = nil
+	if reducef == "" {
+		// the reduce function was deleted
+		s.ops = append(s.ops, reduceValueOps(reducepath, oldvalue, types.Tree{})...)
+	} else {
+		env := views.Env{Require: libraryLoader(p, rec.get)}
+
+		// all documents are reduced again, so only errors from now are kept
+		db.clearViewErrors(p, "reduce")
+		reduced := types.Tree{}
+		for _, dr := range rows {
+			result, err := execReduce(reducef, "add", reduced, dr.row, dr.docid, env)
+			if err != nil {
+				log.Error("reduce function returned error.",
+					"err", err,
+					"base", p,
+					"reducef", reducef,
+					"emitted", dr.row,
+					"key", dr.docid)
+				db.saveViewError(p, dr.docid, "reduce", err)
+				continue
+			}
+			reduced = result
+		}
+		s.ops = append(s.ops, reduceValueOps(reducepath, oldvalue, reduced)...)
+	}
+	s.reducedeps = rec.paths
+
+	// now replace the lists of rows emitted by each document
+	mappedprefix := mappedPrefix(p)
+	iter = db.local.ReadRange(&slu.RangeOpts{
+		Start: mappedprefix,
+		End:   mappedprefix + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		docid := strings.TrimPrefix(iter.Key(), mappedprefix)
+		if _, ok := mapped[docid]; !ok {
+			s.localops = append(s.localops, slu.Del(iter.Key()))
+		}
+	}
+	iter.Release()
+	for docid, relpaths := range mapped {
+		s.localops = append(s.localops, slu.Put(mappedprefix+docid, strings.Join(relpaths, SEP)))
+	}
+	s.localops = append(s.localops,
+		slu.Put("viewupdated:"+p.Join(), time.Now().UTC().Format(time.RFC3339Nano)),
+		slu.Del(swappingKey(p)))
+
+	return s, nil
+}
+
+// commitSwap writes a swap. the main and local stores can't be written in
+// a single batch, so the view is marked at "swapping:<path>" until both are
+// written. if the process dies in between, Check reports it and Repair
+// rebuilds the view.
+func (db *SummaDB) commitSwap(p types.Path, s swap) error {
+	if err := db.local.Put(swappingKey(p), s.mapf); err != nil {
+		return err
+	}
+	db.snapshotmu.RLock()
+	defer db.snapshotmu.RUnlock()
+	if err := db.batch(s.ops); err != nil {
+		return err
+	}
+	db.updateDependencies(p, "!reduce", s.reducedeps)
+	return db.local.Batch(s.localops)
+}
+
+// dropViewRows returns the operations that remove all rows of the view at p,
+// its reduced value and the views defined on its rows.
+func (db *SummaDB) dropViewRows(p types.Path) []levelup.Operation {
+	return append(db.dropBranches(p.Child("!map")), db.dropReducedValue(p)...)
+}
+
+// dropReducedValue returns the operations that remove the reduced value
+// of the view at p.
+func (db *SummaDB) dropReducedValue(p types.Path) []levelup.Operation {
+	return db.dropBranches(p.Child("!reduce"))
+}
+
+// dropBranches returns the operations that remove everything under p,
+// but not p itself.
+func (db *SummaDB) dropBranches(p types.Path) []levelup.Operation {
+	var ops []levelup.Operation
+	iter := db.ReadRange(&slu.RangeOpts{
+		Start: p.Join() + "/",
+		End:   p.Join() + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		ops = append(ops, slu.Del(iter.Key()))
+	}
+	iter.Release()
+	return ops
+}
+
+// discardStagedRows deletes everything staged by the build.
+func (db *SummaDB) discardStagedRows(p types.Path, b *build) {
+	var ops []levelup.Operation
+
+	prefix := stagingPrefix(p, b)
+	iter := db.local.ReadRange(&slu.RangeOpts{
+		Start: prefix,
+		End:   prefix + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		ops = append(ops, slu.Del(iter.Key()))
+	}
+	iter.Release()
+
+	err := db.local.Batch(ops)
+	if err != nil {
+		log.Error("failed to discard staged rows.",
+			"err", err,
+			"path", p)
+	}
+}
@@ -0,0 +1,59 @@
+package database
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+)
+
+// setViewFunctions stores the map and reduce functions of a view defined on
+// the rows of another view, at a path inside its "!map". the rows themselves
+// can't be modified, so t can only have functions.
+func (db *SummaDB) setViewFunctions(p types.Path, t types.Tree) error {
+	if t.Leaf.Kind != types.UNDEFINED || len(t.Branches) > 0 || t.Deleted || isSpecialKey(p.Last()) {
+		return errors.New("only map and reduce functions can be set on view rows: " + p.Join())
+	}
+
+	// check if the toplevel rev matches and cancel everything if it doesn't
+	if err := db.checkRev(t.Rev, p); err != nil {
+		return err
+	}
+
+	var ops []levelup.Operation
+	set := func(key string, value string) {
+		if value == "" {
+			ops = append(ops, slu.Del(p.Child(key).Join()))
+		} else {
+			ops = append(ops, slu.Put(p.Child(key).Join(), value))
+		}
+	}
+
+	set("!map", t.Map)
+	set("!reduce", t.Reduce)
+	if t.MapDepth > 1 {
+		set("!mapdepth", strconv.Itoa(t.MapDepth))
+	} else {
+		set("!mapdepth", "")
+	}
+
+	// bump the revs of the row and of its ancestors, except for the "!map"
+	// keys that hold the rows, which aren't documents.
+	for parent := p; ; parent = parent.Parent() {
+		if parent.Last() != "!map" {
+			rev, _ := db.Get(parent.Child("_rev").Join())
+			ops = append(ops, slu.Put(parent.Child("_rev").Join(), bumpRev(rev)))
+		}
+		if len(parent) == 0 {
+			break
+		}
+	}
+
+	err := db.Batch(ops)
+	if err == nil {
+		go db.rebuildView(t.Map, p)
+	}
+	return err
+}
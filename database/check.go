@@ -0,0 +1,420 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+	"github.com/summadb/summadb/views"
+)
+
+// Problem is an inconsistency found by Check.
+type Problem struct {
+	Kind     string `json:"kind"`
+	Path     string `json:"path"`
+	Detail   string `json:"detail,omitempty"`
+	Repaired bool   `json:"repaired,omitempty"`
+}
+
+// kinds of problems.
+const (
+	MissingRev       = "missing-rev"        // a node has a value but no _rev
+	DeletedWithValue = "deleted-with-value" // a node marked as deleted still has a value
+	StaleRev         = "stale-rev"          // a node has an older rev than one of its children
+	UnmappedRow      = "unmapped-row"       // a row no document is known to have emitted
+	MissingRow       = "missing-row"        // a row known to be emitted is not stored
+	WrongReduce      = "wrong-reduce"       // a reduced value is not the reduction of the rows
+	InterruptedSwap  = "interrupted-swap"   // the rows of a rebuilt view were only partly written
+)
+
+// Check walks the tree at p, and the views defined in it, looking for the
+// inconsistencies left by crashes in the middle of the background updates
+// of views. views being rebuilt are skipped. it should be run while
+// nothing else is writing to the database.
+func (db *SummaDB) Check(p types.Path) ([]Problem, error) {
+	return db.check(p, false)
+}
+
+// Repair is like Check, but fixes the problems it finds: missing and stale
+// revs are bumped, values win over deletion markers, rows nobody emitted are
+// removed, documents whose rows are missing are mapped again, reduced
+// values are replaced by their recomputation and views whose rebuild was
+// interrupted are rebuilt.
+func (db *SummaDB) Repair(p types.Path) ([]Problem, error) {
+	return db.check(p, true)
+}
+
+func (db *SummaDB) check(p types.Path, repair bool) (problems []Problem, err error) {
+	if !p.ReadValid() || p.InsideView() {
+		return nil, errors.New("cannot check invalid path: " + p.Join())
+	}
+
+	report := func(kind string, path types.Path, detail string) {
+		problems = append(problems, Problem{kind, path.Join(), detail, repair})
+	}
+
+	type node struct {
+		value   bool
+		deleted bool
+		rev     string
+	}
+	nodes := make(map[string]*node)
+	get := func(path string) *node {
+		n, ok := nodes[path]
+		if !ok {
+			n = &node{}
+			nodes[path] = n
+		}
+		return n
+	}
+	var viewpaths []types.Path
+
+	iter := db.ReadRange(&slu.RangeOpts{
+		Start: p.Join(),
+		End:   p.Join() + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			iter.Release()
+			return nil, err
+		}
+
+		path := types.ParsePath(iter.Key())
+		switch path.Last() {
+		case "_rev":
+			get(path.Parent().Join()).rev = iter.Value()
+		case "_del":
+			get(path.Parent().Join()).deleted = true
+		case "!map":
+			if iter.Value() != "" {
+				viewpaths = append(viewpaths, path.Parent())
+			}
+		case "_arr", "!mapdepth", "!reduce":
+		default:
+			// branches may be stored with an empty value
+			if iter.Value() != "" {
+				get(path.Join()).value = true
+			}
+		}
+	}
+	iter.Release()
+
+	// views defined on the rows of other views are stored with the rows
+	viewiter := db.readKeyspaces([]string{viewSpace}, &slu.RangeOpts{
+		Start: p.Join(),
+		End:   p.Join() + rangeEnd,
+	})
+	for ; viewiter.Valid(); viewiter.Next() {
+		if err = viewiter.Error(); err != nil {
+			viewiter.Release()
+			return nil, err
+		}
+
+		path := types.ParsePath(viewiter.Key())
+		if path.Last() == "!map" && viewiter.Value() != "" {
+			viewpaths = append(viewpaths, path.Parent())
+		}
+	}
+	viewiter.Release()
+
+	// all nodes between p and the ones found must be checked too
+	for path := range nodes {
+		for parent := types.ParsePath(path); len(parent) > len(p); {
+			parent = parent.Parent()
+			get(parent.Join())
+		}
+	}
+
+	// deepest nodes first, so their parents are checked against their fixed revs
+	paths := make([]types.Path, 0, len(nodes))
+	for path := range nodes {
+		paths = append(paths, types.ParsePath(path))
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if len(paths[i]) != len(paths[j]) {
+			return len(paths[i]) > len(paths[j])
+		}
+		return paths[i].Join() < paths[j].Join()
+	})
+
+	var ops []levelup.Operation
+	fixedrevs := make(map[string]bool)
+	for _, path := range paths {
+		n := nodes[path.Join()]
+
+		if n.value && n.rev == "" {
+			report(MissingRev, path, "")
+			n.rev = bumpRev("")
+			fixedrevs[path.Join()] = true
+		}
+		if n.value && n.deleted {
+			report(DeletedWithValue, path, "")
+			ops = append(ops, slu.Del(path.Child("_del").Join()))
+		}
+
+		if len(path) > len(p) {
+			parentpath := path.Parent()
+			parent := nodes[parentpath.Join()]
+			if fixed, ok := newerRev(parent.rev, n.rev); ok {
+				if !fixedrevs[parentpath.Join()] {
+					report(StaleRev, parentpath, "older than "+path.Last()+"/_rev, at "+n.rev)
+				}
+				parent.rev = fixed
+				fixedrevs[parentpath.Join()] = true
+			}
+		}
+	}
+
+	// ancestors of p must be newer than it too
+	son := p.Copy()
+	sonrev := get(p.Join()).rev
+	for parent := son.Parent(); !parent.Equals(son); parent = son.Parent() {
+		rev, _ := db.Get(parent.Child("_rev").Join())
+		if fixed, ok := newerRev(rev, sonrev); ok {
+			report(StaleRev, parent, "older than "+son.Last()+"/_rev, at "+sonrev)
+			nodes[parent.Join()] = &node{rev: fixed}
+			fixedrevs[parent.Join()] = true
+			rev = fixed
+		}
+		son = parent
+		sonrev = rev
+	}
+
+	if repair {
+		for path := range fixedrevs {
+			ops = append(ops, slu.Put(types.ParsePath(path).Child("_rev").Join(), nodes[path].rev))
+		}
+		if err = db.Batch(ops); err != nil {
+			return problems, err
+		}
+	}
+
+	for _, viewpath := range viewpaths {
+		if _, building := db.BuildProgress(viewpath); building {
+			continue
+		}
+		if mapf, err := db.local.Get(swappingKey(viewpath)); err == nil {
+			problems = append(problems, Problem{InterruptedSwap, viewpath.Join(), "", repair})
+			if repair {
+				db.rebuildView(mapf, viewpath)
+			}
+			continue
+		}
+
+		viewproblems, err := db.checkView(viewpath, repair)
+		problems = append(problems, viewproblems...)
+		if err != nil {
+			return problems, err
+		}
+	}
+
+	return problems, nil
+}
+
+// newerRev tells if rev is older than the rev of one of its children,
+// and returns the one that should replace it.
+func newerRev(rev, childrev string) (string, bool) {
+	v, suffix := revNumber(rev)
+	childv, _ := revNumber(childrev)
+	if childrev == "" || v >= childv {
+		return rev, false
+	}
+	return bumpRev(strconv.Itoa(childv) + "-" + suffix), true
+}
+
+// emittedRows returns the relative paths of all rows the documents
+// of the view at viewpath are known to have emitted, with their ids.
+func (db *SummaDB) emittedRows(viewpath types.Path) (map[string]string, error) {
+	emitted := make(map[string]string)
+
+	prefix := mappedPrefix(viewpath)
+	iter := db.local.ReadRange(&slu.RangeOpts{
+		Start: prefix,
+		End:   prefix + rangeEnd,
+	})
+	defer iter.Release()
+	for ; iter.Valid(); iter.Next() {
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+
+		docid := strings.TrimPrefix(iter.Key(), prefix)
+		for _, relpath := range strings.Split(iter.Value(), SEP) {
+			if relpath != "" {
+				emitted[relpath] = docid
+			}
+		}
+	}
+	return emitted, nil
+}
+
+func (db *SummaDB) checkView(viewpath types.Path, repair bool) (problems []Problem, err error) {
+	report := func(kind string, path types.Path, detail string) {
+		problems = append(problems, Problem{kind, path.Join(), detail, repair})
+	}
+
+	emitted, err := db.emittedRows(viewpath)
+	if err != nil {
+		return nil, err
+	}
+
+	// every key under !map belongs to one of the emitted rows,
+	// except the ones of views defined on them.
+	var ops []levelup.Operation
+	found := make(map[string]bool)
+	rowspath := viewpath.Child("!map")
+	iter := db.ReadRange(&slu.RangeOpts{
+		Start: rowspath.Join() + "/",
+		End:   rowspath.Join() + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			iter.Release()
+			return nil, err
+		}
+
+		path := types.ParsePath(iter.Key())
+		relpath := path.RelativeTo(rowspath)
+		if isSpecialPath(relpath.Join()) {
+			continue
+		}
+
+		matched := false
+		for i := len(relpath); i > 0; i-- {
+			if _, ok := emitted[relpath[:i].Join()]; ok {
+				found[relpath[:i].Join()] = true
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			report(UnmappedRow, path, "")
+			ops = append(ops, slu.Del(iter.Key()))
+		}
+	}
+	iter.Release()
+
+	relpaths := make([]string, 0, len(emitted))
+	for relpath := range emitted {
+		relpaths = append(relpaths, relpath)
+	}
+	sort.Strings(relpaths)
+
+	remap := make(map[string]bool)
+	for _, relpath := range relpaths {
+		if !found[relpath] {
+			report(MissingRow, append(rowspath.Copy(), types.ParsePath(relpath)...),
+				"emitted by "+emitted[relpath])
+			remap[emitted[relpath]] = true
+		}
+	}
+
+	if repair {
+		if err = db.Batch(ops); err != nil {
+			return problems, err
+		}
+		for docid := range remap {
+			db.remapDocument(viewpath, docid)
+		}
+		if emitted, err = db.emittedRows(viewpath); err != nil {
+			return problems, err
+		}
+	}
+
+	// the reduced value must be the reduction of all rows
+	reducepath := viewpath.Child("!reduce")
+	reducef, _ := db.Get(reducepath.Join())
+	if reducef == "" {
+		return problems, nil
+	}
+	current, err := db.Read(reducepath)
+	if err != nil && err != levelup.NotFound {
+		return problems, err
+	}
+
+	rows := make([]types.EmittedRow, 0, len(emitted))
+	docids := make([]string, 0, len(emitted))
+	for relpath, docid := range emitted {
+		rows = append(rows, types.EmittedRow{RelativePath: types.ParsePath(relpath)})
+		docids = append(docids, docid)
+	}
+	sort.Sort(byDocAndPath{rows, docids})
+
+	env := views.Env{Require: libraryLoader(viewpath, (&recorder{db: db}).get)}
+	reduced := types.Tree{}
+	for i, row := range rows {
+		row.Value, err = db.Read(append(rowspath.Copy(), row.RelativePath...))
+		if err != nil {
+			return problems, err
+		}
+		result, err := execReduce(reducef, "add", reduced, row, docids[i], env)
+		if err != nil {
+			// these are reported as view errors
+			continue
+		}
+		reduced = result
+	}
+
+	if !sameTree(current, reduced) {
+		report(WrongReduce, reducepath, "")
+		if repair {
+			if err = db.Batch(reduceValueOps(reducepath, current, reduced)); err != nil {
+				return problems, err
+			}
+		}
+	}
+
+	return problems, nil
+}
+
+// byDocAndPath sorts rows by the document that emitted them and then by path,
+// the order in which they're reduced when a view is rebuilt.
+type byDocAndPath struct {
+	rows   []types.EmittedRow
+	docids []string
+}
+
+func (s byDocAndPath) Len() int { return len(s.rows) }
+func (s byDocAndPath) Less(i, j int) bool {
+	if s.docids[i] != s.docids[j] {
+		return s.docids[i] < s.docids[j]
+	}
+	return s.rows[i].RelativePath.Join() < s.rows[j].RelativePath.Join()
+}
+func (s byDocAndPath) Swap(i, j int) {
+	s.rows[i], s.rows[j] = s.rows[j], s.rows[i]
+	s.docids[i], s.docids[j] = s.docids[j], s.docids[i]
+}
+
+// sameTree tells if two trees have the same values, ignoring revs and deleted branches.
+func sameTree(a, b types.Tree) bool {
+	if a.Leaf != b.Leaf || a.Array != b.Array {
+		return false
+	}
+
+	count := func(t types.Tree) (n int) {
+		for _, branch := range t.Branches {
+			if !branch.Deleted {
+				n++
+			}
+		}
+		return
+	}
+	if count(a) != count(b) {
+		return false
+	}
+	for key, branch := range a.Branches {
+		if branch.Deleted {
+			continue
+		}
+		other, ok := b.Branches[key]
+		if !ok || other.Deleted || !sameTree(*branch, *other) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package database
+
+import (
+	"time"
+
+	"github.com/summadb/summadb/types"
+	. "gopkg.in/check.v1"
+)
+
+func (s *DatabaseSuite) TestCheck(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	c.Assert(db.Set(types.Path{"food"}, types.Tree{
+		Map:    `emit('by-kind', doc._val, 1)`,
+		Reduce: `acc.count = (acc.count and acc.count._val or 0) + value._val`,
+		Branches: types.Branches{
+			"banana": &types.Tree{Leaf: types.StringLeaf("fruit")},
+			"yam":    &types.Tree{Leaf: types.StringLeaf("tuber")},
+		},
+	}), IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	problems, err := db.Check(types.Path{})
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 0)
+
+	// what crashes in the middle of writes could leave behind
+	db.Put("food/apple", `"fruit"`)
+	db.Put("food/banana/_del", "1")
+	db.Put("food/yam/_rev", "9-aaaaa")
+	db.Put("food/!map/by-kind/mineral", "1")
+	db.Del("food/!map/by-kind/tuber")
+	db.Put("food/!reduce/count", "7")
+
+	problems, err = db.Check(types.Path{"food"})
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 7)
+	c.Assert(problems[0], DeepEquals, Problem{Kind: MissingRev, Path: "food/apple"})
+	c.Assert(problems[1], DeepEquals, Problem{Kind: DeletedWithValue, Path: "food/banana"})
+	c.Assert(problems[2], DeepEquals, Problem{Kind: StaleRev, Path: "food", Detail: "older than yam/_rev, at 9-aaaaa"})
+	c.Assert(problems[3].Kind, Equals, StaleRev) // the root, as food must get a newer rev
+	c.Assert(problems[3].Path, Equals, "")
+	c.Assert(problems[4], DeepEquals, Problem{Kind: UnmappedRow, Path: "food/!map/by-kind/mineral"})
+	c.Assert(problems[5], DeepEquals, Problem{Kind: MissingRow, Path: "food/!map/by-kind/tuber", Detail: "emitted by yam"})
+	c.Assert(problems[6], DeepEquals, Problem{Kind: WrongReduce, Path: "food/!reduce"})
+
+	problems, err = db.Repair(types.Path{"food"})
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 7)
+	c.Assert(problems[0].Repaired, Equals, true)
+
+	problems, err = db.Check(types.Path{})
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 0)
+
+	food, _ := db.Read(types.Path{"food"})
+	c.Assert(food.Rev, Matches, "10-.*")
+	c.Assert(food.Branches["apple"].Rev, Matches, "1-.*")
+	c.Assert(food.Branches["banana"].Deleted, Equals, false)
+	rows, _ := db.Read(types.Path{"food", "!map", "by-kind"})
+	c.Assert(rows.Branches, HasLen, 2)
+	c.Assert(rows.Branches["tuber"].Leaf, DeepEquals, types.NumberLeaf(1))
+	reduced, _ := db.Read(types.Path{"food", "!reduce"})
+	c.Assert(reduced.Branches["count"].Leaf, DeepEquals, types.NumberLeaf(2))
+
+	// views defined on the rows of other views are checked too
+	c.Assert(db.Set(types.Path{"food", "!map", "by-kind"}, types.Tree{
+		Map: `emit('kinds', _key, 1)`,
+	}), IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	paths, err := db.ListViews()
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []types.Path{{"food"}, {"food", "!map", "by-kind"}})
+
+	db.Del("food/!map/by-kind/!map/kinds/fruit")
+	problems, err = db.Check(types.Path{})
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 1)
+	c.Assert(problems[0], DeepEquals, Problem{Kind: MissingRow, Path: "food/!map/by-kind/!map/kinds/fruit", Detail: "emitted by fruit"})
+
+	_, err = db.Repair(types.Path{})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	// a rebuild that died between writing the rows and the lists of rows
+	mapf, _ := db.Get("food/!map")
+	db.local.Put(swappingKey(types.Path{"food"}), mapf)
+	db.Del("food/!map/by-kind/tuber")
+	problems, err = db.Check(types.Path{"food"})
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 1)
+	c.Assert(problems[0], DeepEquals, Problem{Kind: InterruptedSwap, Path: "food"})
+
+	problems, err = db.Repair(types.Path{"food"})
+	c.Assert(err, IsNil)
+	c.Assert(problems, HasLen, 1)
+	_, err = db.local.Get(swappingKey(types.Path{"food"}))
+	c.Assert(err, NotNil)
+	rows, _ = db.Read(types.Path{"food", "!map", "by-kind"})
+	c.Assert(rows.Branches["tuber"].Leaf, DeepEquals, types.NumberLeaf(1))
+}
@@ -1,6 +1,8 @@
 package database
 
 import (
+	"sync"
+
 	slu "github.com/fiatjaf/levelup/stringlevelup"
 )
 
@@ -14,8 +16,40 @@ type Logger interface {
 var log Logger
 
 type SummaDB struct {
-	slu.DB
+	pathDB
 	local slu.DB
+
+	// number of documents waiting to be mapped, by view path
+	pendingmu sync.Mutex
+	pending   map[string]int
+
+	// views being rebuilt in the background, by path
+	buildsmu sync.Mutex
+	builds   map[string]*build
+
+	// writes to the main store hold it for reading, so they can go on
+	// together, and reads that must see the database as it was at a single
+	// moment hold it for writing, as levelup has no snapshots.
+	snapshotmu sync.RWMutex
+}
+
+// newSummaDB refuses databases in other format versions
+// with a FormatError, see Upgrade.
+func newSummaDB(db slu.DB, local slu.DB) (*SummaDB, error) {
+	version, err := storedFormat(db, local)
+	if err != nil {
+		return nil, err
+	}
+	if version != formatVersion {
+		return nil, FormatError{version, formatVersion}
+	}
+
+	return &SummaDB{
+		pathDB:  pathDB{db},
+		local:   local,
+		pending: make(map[string]int),
+		builds:  make(map[string]*build),
+	}, nil
 }
 
 func (db *SummaDB) Erase() {
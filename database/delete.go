@@ -12,7 +12,7 @@ func (db *SummaDB) Delete(p types.Path, rev string) error {
 	var ops []levelup.Operation
 
 	// check if the path is valid for mutating
-	if !p.WriteValid() {
+	if !p.WriteValid() || p.InsideView() {
 		return errors.New("cannot delete invalid path: " + p.Join())
 	}
 
@@ -26,9 +26,12 @@ func (db *SummaDB) Delete(p types.Path, rev string) error {
 
 	alreadyDeleted := make(map[string]bool)
 
+	// views defined anywhere in the subtree
+	removedViews := map[string]bool{p.Join(): true}
+
 	iter := db.ReadRange(&slu.RangeOpts{
 		Start: p.Join(),
-		End:   p.Join() + "~~~",
+		End:   p.Join() + rangeEnd,
 	})
 	defer iter.Release()
 	for ; iter.Valid(); iter.Next() {
@@ -44,6 +47,10 @@ func (db *SummaDB) Delete(p types.Path, rev string) error {
 			// the path was already deleted, so we shouldn't do anything
 			alreadyDeleted[path.Parent().Join()] = true
 		default:
+			if path.Last() == "!map" {
+				removedViews[path.Parent().Join()] = true
+			}
+
 			// drop the value at this path (it doesn't matter,
 			// we're deleting everything besides _rev and _del)
 			ops = append(ops, slu.Del(path.Join()))
@@ -68,6 +75,11 @@ func (db *SummaDB) Delete(p types.Path, rev string) error {
 	rev, _ = db.Get(p.Child("_rev").Join())
 	revsToBump[p.Join()] = rev
 
+	// the rows of the removed views aren't in the range above
+	for viewpath := range removedViews {
+		ops = append(ops, db.dropViewRows(types.ParsePath(viewpath))...)
+	}
+
 	// bump revs
 	for leafpath, oldrev := range revsToBump {
 		p := types.ParsePath(leafpath)
@@ -79,13 +91,18 @@ func (db *SummaDB) Delete(p types.Path, rev string) error {
 	err := db.Batch(ops)
 
 	if err == nil {
-		// if a map is being deleted, trigger a mapf update
+		// if maps are being deleted, trigger mapf updates
 		// no value is going to be emitted, since all child rows are deleted
-		// but we need to clear everything at !map/
-		go db.triggerChildrenMapUpdates("", p)
+		// but we need to clear what is known about them
+		for viewpath := range removedViews {
+			go db.rebuildView("", types.ParsePath(viewpath))
+		}
 
 		// since this is a general subtree modification
 		go db.triggerAncestorMapFunctions(p)
+
+		// and map functions that have read this subtree
+		go db.triggerDependentMapFunctions(p)
 	}
 
 	return err
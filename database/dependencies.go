@@ -0,0 +1,147 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+)
+
+// the paths read with 'get' by the map function of a view when mapping
+// a document are stored at "deps:<viewpath>//<docid>", and for each of them
+// there's a reverse entry at "rdeps:<path>//<viewpath>//<docid>". joined
+// paths never have "//" in them, so the parts can always be told apart.
+
+func dependenciesKey(viewpath types.Path, docid string) string {
+	return "deps:" + viewpath.Join() + "//" + docid
+}
+
+func reverseDependencyKey(dependency string, viewpath types.Path, docid string) string {
+	return "rdeps:" + dependency + "//" + viewpath.Join() + "//" + docid
+}
+
+// updateDependencies replaces the paths docid depends on.
+func (db *SummaDB) updateDependencies(viewpath types.Path, docid string, dependencies []types.Path) {
+	var ops []levelup.Operation
+
+	key := dependenciesKey(viewpath, docid)
+	prev, _ := db.local.Get(key)
+	for _, dependency := range strings.Split(prev, SEP) {
+		if dependency == "" {
+			continue
+		}
+		ops = append(ops, slu.Del(reverseDependencyKey(dependency, viewpath, docid)))
+	}
+
+	seen := make(map[string]bool, len(dependencies))
+	var all []string
+	for _, dependency := range dependencies {
+		if seen[dependency.Join()] {
+			continue
+		}
+		seen[dependency.Join()] = true
+		all = append(all, dependency.Join())
+		ops = append(ops, slu.Put(reverseDependencyKey(dependency.Join(), viewpath, docid), ""))
+	}
+
+	if len(all) > 0 {
+		ops = append(ops, slu.Put(key, strings.Join(all, SEP)))
+	} else if prev != "" {
+		ops = append(ops, slu.Del(key))
+	} else {
+		return
+	}
+
+	err := db.local.Batch(ops)
+	if err != nil {
+		log.Error("failed to store map dependencies.",
+			"err", err,
+			"viewpath", viewpath,
+			"docid", docid)
+	}
+}
+
+// addDependencies adds paths to the ones docid already depends on.
+func (db *SummaDB) addDependencies(viewpath types.Path, docid string, dependencies []types.Path) {
+	if len(dependencies) == 0 {
+		return
+	}
+
+	prev, _ := db.local.Get(dependenciesKey(viewpath, docid))
+	for _, dependency := range strings.Split(prev, SEP) {
+		if dependency != "" {
+			dependencies = append(dependencies, types.ParsePath(dependency))
+		}
+	}
+	db.updateDependencies(viewpath, docid, dependencies)
+}
+
+// triggerDependentMapFunctions maps again all documents whose map function
+// has read p, something inside p or something that contains p. views whose
+// reduce function has read it (their dependencies are stored with "!reduce"
+// as the docid) are rebuilt.
+func (db *SummaDB) triggerDependentMapFunctions(p types.Path) {
+	type dependent struct {
+		viewpath types.Path
+		docid    string
+	}
+	var dependents []dependent
+
+	collect := func(start, end string) {
+		iter := db.local.ReadRange(&slu.RangeOpts{Start: start, End: end})
+		defer iter.Release()
+		for ; iter.Valid(); iter.Next() {
+			// the key is rdeps:<path>//<viewpath>//<docid>
+			spl := strings.Split(strings.TrimPrefix(iter.Key(), "rdeps:"), "//")
+			if len(spl) != 3 {
+				continue
+			}
+			dependents = append(dependents, dependent{
+				viewpath: types.ParsePath(spl[1]),
+				docid:    spl[2],
+			})
+		}
+	}
+
+	// p and its ancestors
+	son := p.Copy()
+	for {
+		collect("rdeps:"+son.Join()+"//", "rdeps:"+son.Join()+"//"+rangeEnd)
+		parent := son.Parent()
+		if parent.Equals(son) {
+			break
+		}
+		son = parent
+	}
+
+	// everything inside p
+	if len(p) > 0 {
+		collect("rdeps:"+p.Join()+"/", "rdeps:"+p.Join()+"/"+rangeEnd)
+	} else {
+		collect("rdeps:", "rdeps:"+rangeEnd)
+	}
+
+	rebuilt := make(map[string]bool)
+	for _, d := range dependents {
+		if d.docid != "!reduce" || rebuilt[d.viewpath.Join()] {
+			continue
+		}
+		rebuilt[d.viewpath.Join()] = true
+		mapf, _ := db.Get(d.viewpath.Child("!map").Join())
+		db.rebuildView(mapf, d.viewpath)
+	}
+
+	seen := make(map[string]bool, len(dependents))
+	for _, d := range dependents {
+		if rebuilt[d.viewpath.Join()] {
+			continue
+		}
+		docpath := docPath(d.viewpath, d.docid)
+		if seen[docpath.Join()] {
+			continue
+		}
+		seen[docpath.Join()] = true
+		db.remapDocument(d.viewpath, d.docid)
+	}
+}
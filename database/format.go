@@ -0,0 +1,118 @@
+package database
+
+import (
+	"strconv"
+
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+)
+
+// formatVersion is the version of the layout of the keys in the main
+// and local stores, recorded in the local store at "formatversion".
+// any change to where things are stored must bump it and register a
+// migration from the previous version. in version 1 the keys were paths
+// of raw keys joined by "/", in 2 they are tuples of escaped keys split in
+// keyspaces and the local store has the state of each view under its path.
+const formatVersion = 2
+
+// FormatError is returned when opening a database stored in a format
+// other than the one this version of summadb uses.
+type FormatError struct {
+	Version int // the format of the database
+	Current int // the format summadb uses
+}
+
+func (e FormatError) Error() string {
+	if e.Version < e.Current {
+		return "database is in format " + strconv.Itoa(e.Version) +
+			", it must be upgraded to format " + strconv.Itoa(e.Current)
+	}
+	return "database is in format " + strconv.Itoa(e.Version) +
+		", newer than format " + strconv.Itoa(e.Current) + ", the latest supported"
+}
+
+type migration struct {
+	to  int
+	run func(main, local slu.DB) error
+}
+
+// migrations upgrade a database from a format version (the key)
+// to the next. each one must be safe to run again after being interrupted.
+var migrations = make(map[int]migration)
+
+func registerMigration(from, to int, run func(main, local slu.DB) error) {
+	migrations[from] = migration{to, run}
+}
+
+func init() {
+	registerMigration(1, 2, encodeRawPaths)
+}
+
+// storedFormat returns the format version of a database. databases from
+// before it was recorded have it guessed and recorded, new ones get
+// the current version.
+func storedFormat(main, local slu.DB) (int, error) {
+	if value, err := local.Get("formatversion"); err == nil {
+		return strconv.Atoi(value)
+	}
+
+	version := formatVersion
+	iter := main.ReadRange(&slu.RangeOpts{Limit: 1})
+	if iter.Valid() {
+		version = 1
+	}
+	iter.Release()
+
+	if err := local.Put("formatversion", strconv.Itoa(version)); err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// Upgrade runs all migrations needed to bring the database at location,
+// given as "<backend>:<path>", to the current format version. if it is
+// interrupted, it can just be called again.
+func Upgrade(location string) error {
+	backend, path, err := ParseLocation(location)
+	if err != nil {
+		return err
+	}
+	main, err := openStore(backend, path)
+	if err != nil {
+		return err
+	}
+	defer main.Close()
+	local, err := openStore(backend, path+"_local")
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+
+	return upgrade(slu.StringDB(main), slu.StringDB(local))
+}
+
+func upgrade(main, local slu.DB) error {
+	version, err := storedFormat(main, local)
+	if err != nil {
+		return err
+	}
+	if version > formatVersion {
+		return FormatError{version, formatVersion}
+	}
+
+	for version < formatVersion {
+		m, ok := migrations[version]
+		if !ok {
+			return FormatError{version, formatVersion}
+		}
+
+		log.Info("upgrading database format.", "from", version, "to", m.to)
+		if err := m.run(main, local); err != nil {
+			return err
+		}
+		version = m.to
+		if err := local.Put("formatversion", strconv.Itoa(version)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package database
 
 import (
+	"strings"
+
 	"github.com/summadb/summadb/types"
 )
 
@@ -8,3 +10,24 @@ type fupdated struct {
 	path types.Path
 	code string
 }
+
+// rangeEnd is appended to a prefix to make the end of the range of all keys
+// that start with it. it is a byte that never appears in UTF-8 keys.
+const rangeEnd = "\xff"
+
+// isSpecialPath tells if any of the keys in the "/"-separated path
+// is a special key.
+func isSpecialPath(path string) bool {
+	for _, key := range strings.Split(path, "/") {
+		if isSpecialKey(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSpecialKey tells if key is a special key, like _rev or !map,
+// instead of the key of a document.
+func isSpecialKey(key string) bool {
+	return key == "" || key[0] == '_' || key[0] == '!'
+}
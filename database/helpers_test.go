@@ -1,6 +1,10 @@
 package database
 
 import (
+	"time"
+
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
 	. "gopkg.in/check.v1"
 )
 
@@ -38,3 +42,68 @@ func (s *DatabaseSuite) TestRevFromParents(c *C) {
 	c.Assert(revFromParents("6-yhxbc", "6-uyrbc"), Equals, "9-0NWbc")
 	c.Assert(revFromParents("3-yuiop", "3-yuiop"), Equals, "3-yuiop")
 }
+
+func (s *DatabaseSuite) TestKeyEncoding(c *C) {
+	for _, key := range []string{"", "a", "a/b", "a/_rev", "x\x00y/z", "ação/!map/b"} {
+		c.Assert(decodeKey(encodeKey(key)), Equals, key)
+	}
+
+	// a path comes before everything inside it, which comes before its siblings
+	ordered := []string{"a", "a/_rev", "a/b", "a/b/c", "a/ção", "a\x00", "a%25", "a-2", "ab", "b"}
+	for i := 1; i < len(ordered); i++ {
+		c.Assert(encodeTuple(dataSpace, ordered[i-1]) < encodeTuple(dataSpace, ordered[i]), Equals, true,
+			Commentf("%q < %q", ordered[i-1], ordered[i]))
+	}
+	for _, key := range ordered[:6] {
+		c.Assert(encodeTuple(dataSpace, key) <= encodeTuple(dataSpace, "a"+rangeEnd), Equals, key != "a\x00",
+			Commentf("%q", key))
+	}
+
+	c.Assert(keyspace("a/b"), Equals, dataSpace)
+	c.Assert(keyspace("!lib/sum"), Equals, dataSpace)
+	c.Assert(keyspace("a/_rev"), Equals, metaSpace)
+	c.Assert(keyspace("a/_arr"), Equals, metaSpace)
+	c.Assert(keyspace("a/!map"), Equals, metaSpace)
+	c.Assert(keyspace("a/!reduce"), Equals, metaSpace)
+	c.Assert(keyspace("a/!map/x/_rev"), Equals, viewSpace)
+	c.Assert(keyspace("a/!map/x/!map"), Equals, viewSpace)
+	c.Assert(keyspace("a/!reduce/total"), Equals, viewSpace)
+}
+
+func (s *DatabaseSuite) TestKeyspaces(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	c.Assert(db.Set(types.Path{"food"}, types.Tree{
+		Branches: types.Branches{
+			"banana": &types.Tree{Leaf: types.StringLeaf("fruit")},
+		},
+		Map: `emit('by-kind', doc._val, 1)`,
+	}), IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	// reading the data goes only through data and metadata
+	iter := db.ReadRange(&slu.RangeOpts{Start: "food", End: "food" + rangeEnd})
+	for ; iter.Valid(); iter.Next() {
+		c.Assert(keyspace(iter.Key()), Not(Equals), viewSpace, Commentf("%q", iter.Key()))
+	}
+	iter.Release()
+
+	// and reading the rows goes only through the view
+	rows, err := db.Read(types.Path{"food", "!map", "by-kind"})
+	c.Assert(err, IsNil)
+	c.Assert(rows.Branches, HasLen, 1)
+	c.Assert(rows.Branches["fruit"].Leaf, DeepEquals, types.NumberLeaf(1))
+
+	// replacing the tree without the map function removes its rows
+	rev, _ := db.Rev(types.Path{"food"})
+	c.Assert(db.Set(types.Path{"food"}, types.Tree{
+		Rev: rev,
+		Branches: types.Branches{
+			"banana": &types.Tree{Leaf: types.StringLeaf("fruit")},
+		},
+	}), IsNil)
+	rows, err = db.Read(types.Path{"food", "!map", "by-kind"})
+	c.Assert(err, IsNil)
+	c.Assert(rows.Branches, HasLen, 0)
+}
@@ -0,0 +1,312 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+)
+
+// keys in the main database are paths, but they are not stored joined by "/":
+// each segment is followed by keySeparator, which sorts before any other byte
+// that can come after a segment (a zero byte inside a segment is stored as
+// "\x00\xff"). this way the keys of a subtree are exactly the ones that start
+// with the encoded path of its root, and they come right after it, before
+// the keys of any of its siblings.
+const keySeparator = "\x00\x01"
+
+// each key is also prefixed by the keyspace it belongs to, so reading data
+// never goes through the rows of the views defined on it, and vice versa.
+const (
+	dataSpace = "\x01" // values
+	metaSpace = "\x02" // _rev, _del, _arr and the code of map and reduce functions
+	viewSpace = "\x03" // everything under a !map or !reduce: rows and reduced values
+)
+
+// pathDB is the main database. it takes and returns keys as "/"-joined paths,
+// which are encoded before they're stored. a key ending in rangeEnd, as the
+// End of a range, is encoded without it and then gets it back, so the range
+// from p to p + rangeEnd has exactly p and everything inside it, and the range
+// from p + "/" to p + rangeEnd has only what is inside p.
+//
+// ranges starting under a !map or !reduce are read from the view keyspace,
+// all others from the data and metadata keyspaces together.
+type pathDB struct {
+	slu.DB
+}
+
+// keyspace tells where the value at key is stored.
+func keyspace(key string) string {
+	segments := strings.Split(key, "/")
+	for _, segment := range segments[:len(segments)-1] {
+		if segment == "!map" || segment == "!reduce" {
+			return viewSpace
+		}
+	}
+	if last := segments[len(segments)-1]; last != "" && isSpecialKey(last) {
+		return metaSpace
+	}
+	return dataSpace
+}
+
+// rangeKeyspaces tells where the keys of a range starting at start are stored.
+func rangeKeyspaces(start string) []string {
+	for _, segment := range strings.Split(start, "/") {
+		if segment == "!map" || segment == "!reduce" {
+			return []string{viewSpace}
+		}
+	}
+	return []string{dataSpace, metaSpace}
+}
+
+func encodeKey(key string) string {
+	return encodeTuple(keyspace(key), key)
+}
+
+func encodeTuple(space, key string) string {
+	end := strings.HasSuffix(key, rangeEnd)
+	key = strings.TrimSuffix(key, rangeEnd)
+
+	encoded := []byte(space)
+	if key != "" {
+		for _, segment := range strings.Split(key, "/") {
+			encoded = append(encoded, strings.Replace(segment, "\x00", "\x00\xff", -1)...)
+			encoded = append(encoded, keySeparator...)
+		}
+	}
+	if end {
+		encoded = append(encoded, rangeEnd...)
+	}
+	return string(encoded)
+}
+
+func decodeKey(encoded string) string {
+	return decodeTuple(encoded[len(dataSpace):])
+}
+
+func decodeTuple(encoded string) string {
+	encoded = strings.TrimSuffix(encoded, keySeparator)
+	segments := strings.Split(encoded, keySeparator)
+	for i, segment := range segments {
+		segments[i] = strings.Replace(segment, "\x00\xff", "\x00", -1)
+	}
+	return strings.Join(segments, "/")
+}
+
+func (db pathDB) Get(key string) (string, error) { return db.DB.Get(encodeKey(key)) }
+func (db pathDB) Put(key, value string) error    { return db.DB.Put(encodeKey(key), value) }
+func (db pathDB) Del(key string) error           { return db.DB.Del(encodeKey(key)) }
+
+func (db pathDB) Batch(ops []levelup.Operation) error {
+	encoded := make([]levelup.Operation, len(ops))
+	for i, op := range ops {
+		op.Key = []byte(encodeKey(string(op.Key)))
+		encoded[i] = op
+	}
+	return db.DB.Batch(encoded)
+}
+
+func (db pathDB) ReadRange(opts *slu.RangeOpts) *pathIterator {
+	return db.readKeyspaces(rangeKeyspaces(opts.Start), opts)
+}
+
+// readKeyspaces reads a range from the given keyspaces, whatever its start.
+func (db pathDB) readKeyspaces(spaces []string, opts *slu.RangeOpts) *pathIterator {
+	iter := &pathIterator{reverse: opts.Reverse}
+	for _, space := range spaces {
+		encoded := *opts
+		encoded.Start = encodeTuple(space, opts.Start)
+		encoded.End = encodeTuple(space, opts.End)
+		iter.iters = append(iter.iters, db.DB.ReadRange(&encoded))
+	}
+	iter.pick()
+	return iter
+}
+
+// pathIterator goes through the keys of one or more keyspaces in order,
+// as if they were all in the same one.
+type pathIterator struct {
+	iters   []slu.ReadIterator
+	reverse bool
+	current int
+}
+
+// pick finds the iterator that has the next key.
+func (iter *pathIterator) pick() {
+	iter.current = -1
+	var next string
+	for i, it := range iter.iters {
+		if !it.Valid() {
+			continue
+		}
+		key := it.Key()[len(dataSpace):]
+		if iter.current == -1 || (key < next) != iter.reverse {
+			iter.current = i
+			next = key
+		}
+	}
+}
+
+func (iter *pathIterator) Valid() bool { return iter.current != -1 }
+
+func (iter *pathIterator) Next() {
+	iter.iters[iter.current].Next()
+	iter.pick()
+}
+
+func (iter *pathIterator) Error() error {
+	for _, it := range iter.iters {
+		if err := it.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (iter *pathIterator) Key() string   { return decodeKey(iter.iters[iter.current].Key()) }
+func (iter *pathIterator) Value() string { return iter.iters[iter.current].Value() }
+
+func (iter *pathIterator) Release() {
+	for _, it := range iter.iters {
+		it.Release()
+	}
+}
+
+// encodeRawPaths upgrades a database from format 1, whose keys were paths of
+// raw keys joined by "/" in a single keyspace and whose local store only had
+// the lists of rows emitted by each document, at "mapped:<viewpath>:<docid>".
+// the local store goes first, in a single batch, since its keys can only be
+// split with the paths of the views as they were in the main store.
+func encodeRawPaths(main, local slu.DB) error {
+	if err := encodeRawLocalKeys(main, local); err != nil {
+		return err
+	}
+	return rewriteKeys(main, func(key string) string {
+		if strings.Contains(key, keySeparator) {
+			// already encoded
+			return key
+		}
+		return encodeKey(escapePath(key))
+	})
+}
+
+// encodeRawLocalKeys moves the lists of rows to their current keys, with their
+// paths escaped, and fills the index of views.
+func encodeRawLocalKeys(main, local slu.DB) error {
+	// the raw paths of all views
+	views := make(map[string]bool)
+	iter := main.ReadRange(&slu.RangeOpts{})
+	for ; iter.Valid(); iter.Next() {
+		if err := iter.Error(); err != nil {
+			iter.Release()
+			return err
+		}
+
+		key := iter.Key()
+		if strings.Contains(key, keySeparator) {
+			// the main store is being encoded, so this was done already
+			iter.Release()
+			return nil
+		}
+		segments := strings.Split(key, "/")
+		if last := segments[len(segments)-1]; (last == "!map" || last == "!reduce") && iter.Value() != "" {
+			views[strings.Join(segments[:len(segments)-1], "/")] = true
+		}
+	}
+	iter.Release()
+
+	var dels, puts []levelup.Operation
+	for viewpath := range views {
+		puts = append(puts, slu.Put(viewIndexKey(types.ParsePath(escapePath(viewpath))), ""))
+	}
+
+	iter = local.ReadRange(&slu.RangeOpts{
+		Start: "mapped:",
+		End:   "mapped:" + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		if err := iter.Error(); err != nil {
+			iter.Release()
+			return err
+		}
+
+		// both the path of the view and the id of the document may have ":",
+		// so the key is split where the document exists in the view.
+		key := strings.TrimPrefix(iter.Key(), "mapped:")
+		for i := 0; i < len(key); i++ {
+			viewpath, docid := key[:i], key[i+1:]
+			if key[i] != ':' || !views[viewpath] {
+				continue
+			}
+			docpath := docid
+			if viewpath != "" {
+				docpath = viewpath + "/" + docid
+			}
+			if _, err := main.Get(docpath + "/_rev"); err != nil {
+				continue
+			}
+
+			relpaths := strings.Split(iter.Value(), SEP)
+			for j, relpath := range relpaths {
+				relpaths[j] = escapePath(relpath)
+			}
+			puts = append(puts, slu.Put(
+				mappedKey(types.ParsePath(escapePath(viewpath)), types.EscapeKey(docid)),
+				strings.Join(relpaths, SEP)))
+			break
+		}
+		dels = append(dels, slu.Del(iter.Key()))
+	}
+	iter.Release()
+
+	// the old keys are deleted before, as an old key may be the same as a new one
+	return local.Batch(append(dels, puts...))
+}
+
+// rewriteKeys replaces each key of the main store for which rewrite returns
+// a different one, in batches. keys it has already rewritten must be returned
+// unchanged, so it can be run again after being interrupted.
+func rewriteKeys(main slu.DB, rewrite func(key string) string) error {
+	var ops []levelup.Operation
+	flush := func() error {
+		err := main.Batch(ops)
+		ops = ops[:0]
+		return err
+	}
+
+	iter := main.ReadRange(&slu.RangeOpts{})
+	for ; iter.Valid(); iter.Next() {
+		if err := iter.Error(); err != nil {
+			iter.Release()
+			return err
+		}
+
+		key := iter.Key()
+		newkey := rewrite(key)
+		if newkey == key {
+			continue
+		}
+		ops = append(ops, slu.Del(key), slu.Put(newkey, iter.Value()))
+		if len(ops) >= 1000 {
+			if err := flush(); err != nil {
+				iter.Release()
+				return err
+			}
+		}
+	}
+	iter.Release()
+	return flush()
+}
+
+// escapePath escapes each segment of a "/"-joined path of raw keys,
+// except the special ones.
+func escapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !isSpecialKey(segment) {
+			segments[i] = types.EscapeKey(segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,45 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/summadb/summadb/types"
+	"github.com/summadb/summadb/views"
+)
+
+// libraryLoader returns the loader 'require' uses in the functions of the view
+// at viewpath. a library called <name> is the string stored at !lib/<name>
+// in viewpath or in the nearest of its ancestors that has it. libraries are
+// read with get, so they can be tracked as dependencies.
+func libraryLoader(viewpath types.Path, get views.Getter) views.Loader {
+	return func(name string) (string, error) {
+		son := viewpath.Copy()
+		for {
+			lib, err := get(son.Child("!lib").Child(types.EscapeKey(name)))
+			if err != nil {
+				return "", err
+			}
+			if lib.Leaf.Kind == types.STRING {
+				return lib.Leaf.String(), nil
+			}
+
+			parent := son.Parent()
+			if parent.Equals(son) {
+				break
+			}
+			son = parent
+		}
+		return "", errors.New("library not found: " + name)
+	}
+}
+
+// recorder reads from the database and remembers every path it has read.
+type recorder struct {
+	db    *SummaDB
+	paths []types.Path
+}
+
+func (r *recorder) get(p types.Path) (types.Tree, error) {
+	r.paths = append(r.paths, p)
+	return r.db.Read(p)
+}
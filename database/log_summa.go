@@ -1,4 +1,4 @@
-// +build goleveldown rocksdown
+// +build !levelupjs
 
 package database
 
@@ -1,7 +1,9 @@
 package database
 
 import (
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/fiatjaf/levelup"
 	slu "github.com/fiatjaf/levelup/stringlevelup"
@@ -11,65 +13,166 @@ import (
 
 const SEP = "^!~"
 
-func runMap(mapf string, tree types.Tree, key string) []types.EmittedRow {
-	emittedrows, err := views.Map(mapf, tree, key)
+// runMap runs the map function of the view at viewpath on a document, storing
+// the error it throws, if any, so it can be fetched later with ViewErrors,
+// and the paths it read with 'get', so it can be run again when they change.
+func (db *SummaDB) runMap(viewpath types.Path, mapf string, tree types.Tree, key string) []types.EmittedRow {
+	rec := &recorder{db: db}
+	emittedrows, err := execMap(mapf, tree, key, views.Env{
+		Get:     rec.get,
+		Require: libraryLoader(viewpath, rec.get),
+	})
+	db.updateDependencies(viewpath, key, rec.paths)
 	if err != nil {
-		log.Error("views.Map returned error.",
+		log.Error("map function returned error.",
 			"err", err,
 			"mapf", mapf,
 			"docid", key)
+		db.saveViewError(viewpath, key, "map", err)
+		return nil
 	}
+	db.clearViewError(viewpath, "map", key)
 	return emittedrows
 }
 
+// mapDepth returns the level, relative to viewpath, of the documents
+// the map function at viewpath is run on.
+func (db *SummaDB) mapDepth(viewpath types.Path) int {
+	value, _ := db.Get(viewpath.Child("!mapdepth").Join())
+	depth, _ := strconv.Atoi(value)
+	if depth < 1 {
+		return 1
+	}
+	return depth
+}
+
+// docPath returns the path of a document of the view at viewpath. docids are
+// paths relative to viewpath, with as many keys as the view's map depth.
+func docPath(viewpath types.Path, docid string) types.Path {
+	return append(viewpath.Copy(), types.ParsePath(docid)...)
+}
+
 func (db *SummaDB) triggerAncestorMapFunctions(p types.Path) {
-	// look through ancestors for map functions
-	son := p.Copy()
-	for parent := son.Parent(); !parent.Equals(son); parent = son.Parent() {
-		mapf, _ := db.Get(parent.Child("!map").Join())
-		if mapf != "" {
-			// grab document
-			tree, err := db.Read(son)
-			if err != nil {
-				log.Error("failed to read document to the map function",
-					"err", err,
-					"path", parent)
-				continue
-			}
+	// look through ancestors for map functions, stopping at special keys:
+	// the rows of a view are not part of the documents of the views above it.
+	for i := len(p) - 1; i >= 0; i-- {
+		if isSpecialKey(p[i]) {
+			break
+		}
 
-			// run map function
-			docpath := son
-			docid := docpath.Last()
-			emittedrows := runMap(mapf, tree, docid)
-			db.updateEmittedRecordsInTheDatabase(docpath.Parent(), docid, emittedrows)
+		viewpath := p[:i].Copy()
+		mapf, _ := db.Get(viewpath.Child("!map").Join())
+		if mapf == "" {
+			continue
 		}
 
-		son = parent
+		relpath := p[i:]
+		depth := db.mapDepth(viewpath)
+		if len(relpath) >= depth {
+			// p is inside a single document
+			db.remapDocument(viewpath, relpath[:depth].Join())
+		} else {
+			// p contains many documents
+			for _, docid := range db.documentsUnder(viewpath, relpath, depth) {
+				db.remapDocument(viewpath, docid)
+			}
+		}
 	}
 }
 
-func (db *SummaDB) triggerChildrenMapUpdates(mapf string, p types.Path) {
-	tree, err := db.Read(p)
+// documentsUnder returns the ids of the documents of the view at viewpath that
+// are inside relpath, the ones that are there now and the ones that have been
+// mapped before (those may have been deleted).
+func (db *SummaDB) documentsUnder(viewpath types.Path, relpath types.Path, depth int) []string {
+	seen := make(map[string]bool)
+	var docids []string
+
+	tree, err := db.Read(append(viewpath.Copy(), relpath...))
 	if err != nil {
-		log.Error("failed to fetch parent tree on triggerChildrenMapUpdates.",
+		log.Error("failed to read tree to find documents.",
 			"err", err,
-			"path", p)
+			"path", relpath)
+	}
+	for docid := range documentsAt(tree, relpath, depth-len(relpath)) {
+		seen[docid] = true
+		docids = append(docids, docid)
+	}
+
+	prefix := mappedPrefix(viewpath) + relpath.Join() + "/"
+	iter := db.local.ReadRange(&slu.RangeOpts{
+		Start: prefix,
+		End:   prefix + rangeEnd,
+	})
+	defer iter.Release()
+	for ; iter.Valid(); iter.Next() {
+		docid := relpath.Join() + "/" + strings.TrimPrefix(iter.Key(), prefix)
+		if !seen[docid] {
+			seen[docid] = true
+			docids = append(docids, docid)
+		}
+	}
+
+	return docids
+}
+
+// documentsAt returns all nodes that are depth levels below tree, by their paths
+// relative to the view, given that tree is itself at relpath.
+func documentsAt(tree types.Tree, relpath types.Path, depth int) map[string]*types.Tree {
+	docs := make(map[string]*types.Tree)
+	if depth == 0 {
+		docs[relpath.Join()] = &tree
+		return docs
+	}
+	for key, branch := range tree.Branches {
+		if isSpecialKey(key) {
+			continue
+		}
+		for docid, doc := range documentsAt(*branch, relpath.Child(key), depth-1) {
+			docs[docid] = doc
+		}
+	}
+	return docs
+}
+
+// remapDocument runs the map function of the view at viewpath, if there is one,
+// on its document docid and replaces the rows it had emitted before.
+func (db *SummaDB) remapDocument(viewpath types.Path, docid string) {
+	if isSpecialPath(docid) {
 		return
 	}
 
-	// mapf will be an empty string if it has been deleted.
+	mapf, _ := db.Get(viewpath.Child("!map").Join())
 	if mapf == "" {
-		// in this case we do an update with new emitted rows,
-		// that will clean the map results.
-		for docid, _ := range tree.Branches {
-			db.updateEmittedRecordsInTheDatabase(p, docid, []types.EmittedRow{})
-		}
+		return
+	}
+
+	// the view is being rebuilt, so let the build map this document again
+	if db.markDirty(viewpath, docid) {
+		return
+	}
+
+	db.addPending(viewpath, 1)
+	defer db.addPending(viewpath, -1)
+
+	// grab document
+	tree, err := db.Read(docPath(viewpath, docid))
+	if err != nil {
+		log.Error("failed to read document to the map function",
+			"err", err,
+			"path", viewpath)
+		return
+	}
+
+	// run map function, unless this is a view defined on the rows of another
+	// and no row is left for this document.
+	var emittedrows []types.EmittedRow
+	if viewpath.InsideView() && tree.Leaf.Kind == types.UNDEFINED && len(tree.Branches) == 0 {
+		db.clearViewError(viewpath, "map", docid)
+		db.updateDependencies(viewpath, docid, nil)
 	} else {
-		for docid, doc := range tree.Branches {
-			emittedrows := runMap(mapf, *doc, docid)
-			db.updateEmittedRecordsInTheDatabase(p, docid, emittedrows)
-		}
+		emittedrows = db.runMap(viewpath, mapf, tree, docid)
 	}
+	db.updateEmittedRecordsInTheDatabase(viewpath, docid, emittedrows)
 }
 
 func (db *SummaDB) updateEmittedRecordsInTheDatabase(
@@ -83,7 +186,7 @@ func (db *SummaDB) updateEmittedRecordsInTheDatabase(
 		allrelativepaths[i] = row.RelativePath.Join()
 	}
 
-	localmetakey := "mapped:" + p.Join() + ":" + docid
+	localmetakey := mappedKey(p, docid)
 
 	// fetch previous emitted rows for this same map and docid
 	prevkeys, err := db.local.Get(localmetakey)
@@ -94,6 +197,10 @@ func (db *SummaDB) updateEmittedRecordsInTheDatabase(
 		return
 	}
 
+	// all row removals and insertions for this docid go in a single batch
+	var ops []levelup.Operation
+	var removed []types.EmittedRow
+
 	// remove all these emitted rows from the database
 	for _, relativepath := range strings.Split(prevkeys, SEP) {
 		if relativepath == "" {
@@ -101,76 +208,126 @@ func (db *SummaDB) updateEmittedRecordsInTheDatabase(
 		}
 
 		relpath := types.ParsePath(relativepath)
-		deletedRecord, err := db.deleteEmittedRow(p, relpath)
+		deletedRecord, delops, err := db.emittedRowDeletions(p, relpath)
 		if err != nil {
-			log.Error("unexpected error when deleting emitted row from the database.",
+			log.Error("unexpected error when reading emitted row to delete.",
 				"err", err,
 				"relpath", relativepath)
-		} else {
-			// run the "remove" reducer directive
-			row := types.EmittedRow{
-				RelativePath: relpath,
-				Value:        deletedRecord,
-			}
-			err := db.runReduce(p, "remove", row, docid)
-			if err != nil {
-				log.Error("unexpected error when running 'remove' reduce.",
-					"err", err,
-					"row", row)
-			}
+			continue
 		}
+		ops = append(ops, delops...)
+		removed = append(removed, types.EmittedRow{
+			RelativePath: relpath,
+			Value:        deletedRecord,
+		})
 	}
 
-	// store keys emitted by this doc so we can delete/update them later
+	// save all emitted rows in the database
+	for _, row := range emittedrows {
+		ops = append(ops, emittedRowInsertions(p, row.RelativePath, row.Value)...)
+	}
+
+	// store keys emitted by this doc so we can delete/update them later,
+	// and find the doc of each row when querying. queries that include docs
+	// see both writes or none of them.
+	var localop levelup.Operation
 	if len(emittedrows) > 0 {
-		err = db.local.Put(localmetakey, strings.Join(allrelativepaths, SEP))
+		localop = slu.Put(localmetakey, strings.Join(allrelativepaths, SEP))
+	} else {
+		localop = slu.Del(localmetakey)
+	}
+	db.snapshotmu.RLock()
+	err = db.batch(ops)
+	if err != nil {
+		db.snapshotmu.RUnlock()
+		log.Error("unexpected error when writing emitted rows.",
+			"err", err,
+			"path", p,
+			"docid", docid)
+		return
+	}
+	err = db.local.Batch([]levelup.Operation{localop})
+	db.snapshotmu.RUnlock()
+	if err != nil {
+		log.Error("unexpected error when storing list of emitted rows",
+			"err", err,
+			"localmetakey", localmetakey)
+		return
+	}
+
+	// run the "remove" reducer directive. errors from reducing the previous
+	// rows of this document are stored again if they happen again.
+	db.clearViewError(p, "reduce", docid)
+	for _, row := range removed {
+		err := db.runReduce(p, "remove", row, docid)
 		if err != nil {
-			log.Error("unexpected error when storing list of emitted rows",
+			log.Error("unexpected error when running 'remove' reduce.",
 				"err", err,
-				"localmetakey", localmetakey)
-			return
+				"row", row)
 		}
+	}
 
-		// save all emitted rows in the database
-		for _, row := range emittedrows {
-			err = db.saveEmittedRow(p, row.RelativePath, row.Value)
-
-			// run the "add" reducer directive
-			err := db.runReduce(p, "add", row, docid)
-			if err != nil {
-				log.Error("unexpected error when running 'add' reduce.",
-					"err", err,
-					"row", row)
-			}
-		}
-	} else {
-		err = db.local.Del(localmetakey)
+	// run the "add" reducer directive
+	for _, row := range emittedrows {
+		err := db.runReduce(p, "add", row, docid)
 		if err != nil {
-			log.Error("unexpected error when deleting list of emitted rows",
+			log.Error("unexpected error when running 'add' reduce.",
 				"err", err,
-				"localmetakey", localmetakey)
-			return
+				"row", row)
 		}
 	}
+
+	err = db.local.Put("viewupdated:"+p.Join(), time.Now().UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		log.Error("unexpected error when storing view update time.",
+			"err", err,
+			"path", p)
+	}
+
+	// views defined on these rows must be updated too
+	changed := make(map[string]types.Path)
+	for _, row := range append(removed, emittedrows...) {
+		rowpath := append(p.Child("!map"), row.RelativePath...)
+		changed[rowpath.Join()] = rowpath
+	}
+	for _, rowpath := range changed {
+		db.triggerAncestorMapFunctions(rowpath)
+	}
+}
+
+// the relative paths of the rows each document emitted, joined by SEP,
+// are stored at "mapped:<viewpath>//<docid>".
+func mappedKey(viewpath types.Path, docid string) string {
+	return mappedPrefix(viewpath) + docid
+}
+
+func mappedPrefix(viewpath types.Path) string {
+	return "mapped:" + viewpath.Join() + "//"
 }
 
-func (db *SummaDB) deleteEmittedRow(base types.Path, relpath types.Path) (types.Tree, error) {
+// emittedRowDeletions returns the row currently stored at relpath and the
+// operations needed to remove it.
+func (db *SummaDB) emittedRowDeletions(base types.Path, relpath types.Path) (types.Tree, []levelup.Operation, error) {
 	var ops []levelup.Operation
 
 	rpath := append(base.Child("!map"), relpath...)
 	record, err := db.Read(rpath)
 	if err != nil {
-		return record, err
+		return record, nil, err
 	}
 
-	record.Recurse(rpath, func(np types.Path, _ types.Leaf, _ types.Tree) bool {
+	record.Recurse(rpath, func(np types.Path, _ types.Leaf, t types.Tree) bool {
 		ops = append(ops, slu.Del(np.Join()))
+		if t.Array {
+			ops = append(ops, slu.Del(np.Child("_arr").Join()))
+		}
 		return true
 	})
-	return record, db.Batch(ops)
+	return record, ops, nil
 }
 
-func (db *SummaDB) saveEmittedRow(base types.Path, relpath types.Path, value types.Tree) error {
+// emittedRowInsertions returns the operations needed to store value at relpath.
+func emittedRowInsertions(base types.Path, relpath types.Path, value types.Tree) []levelup.Operation {
 	var ops []levelup.Operation
 
 	rowpath := append(base.Child("!map"), relpath...)
@@ -180,8 +337,11 @@ func (db *SummaDB) saveEmittedRow(base types.Path, relpath types.Path, value typ
 				jsonvalue, _ := leaf.MarshalJSON()
 				ops = append(ops, slu.Put(p.Join(), string(jsonvalue)))
 			}
+			if t.Array {
+				ops = append(ops, slu.Put(p.Child("_arr").Join(), "1"))
+			}
 			proceed = true
 			return
 		})
-	return db.Batch(ops)
+	return ops
 }
@@ -2,6 +2,7 @@ package database
 
 import (
 	"errors"
+	"strconv"
 
 	"github.com/fiatjaf/levelup"
 	slu "github.com/fiatjaf/levelup/stringlevelup"
@@ -19,6 +20,11 @@ func (db *SummaDB) Merge(p types.Path, t types.Tree) error {
 		return errors.New("cannot set on invalid path: " + p.Join())
 	}
 
+	// view rows can only get map and reduce functions
+	if p.InsideView() {
+		return db.setViewFunctions(p, t)
+	}
+
 	// check if the toplevel rev matches and cancel everything if it doesn't
 	if err := db.checkRev(t.Rev, p); err != nil {
 		return err
@@ -36,6 +42,7 @@ func (db *SummaDB) Merge(p types.Path, t types.Tree) error {
 		revsToBump[path.Join()] = rev
 
 		mapf, _ := db.Get(path.Child("!map").Join())
+		mapdepth := db.mapDepth(path)
 		reducef, _ := db.Get(path.Child("!reduce").Join())
 
 		if t.Deleted {
@@ -57,7 +64,31 @@ func (db *SummaDB) Merge(p types.Path, t types.Tree) error {
 				ops = append(ops, slu.Put(path.Join(), string(jsonvalue)))
 			}
 
-			if mapf != t.Map {
+			if t.Array {
+				ops = append(ops, slu.Put(path.Child("_arr").Join(), "1"))
+			} else if !isElementsOnly(t) {
+				// a value or an object merged over an array turns it into an
+				// object, while only elements just update them
+				ops = append(ops, slu.Del(path.Child("_arr").Join()))
+			}
+
+			// the depth is only changed when the tree sets it
+			newdepth := mapdepth
+			if t.MapDepth != 0 {
+				newdepth = t.MapDepth
+				if newdepth < 1 {
+					newdepth = 1
+				}
+			}
+			if newdepth != mapdepth {
+				if newdepth > 1 {
+					ops = append(ops, slu.Put(path.Child("!mapdepth").Join(), strconv.Itoa(newdepth)))
+				} else {
+					ops = append(ops, slu.Del(path.Child("!mapdepth").Join()))
+				}
+			}
+
+			if mapf != t.Map || newdepth != mapdepth {
 				ops = append(ops, slu.Put(path.Child("!map").Join(), t.Map))
 
 				// trigger map computations for all direct children of this key
@@ -65,10 +96,15 @@ func (db *SummaDB) Merge(p types.Path, t types.Tree) error {
 			}
 
 			if reducef != t.Reduce {
-				ops = append(ops, slu.Put(path.Child("!reduce").Join(), t.Map))
-
-				// trigger map computations for all direct children of this key
-				mapfUpdated = append(mapfUpdated, fupdated{path.Parent(), t.Map}) // yes, map.
+				ops = append(ops, slu.Put(path.Child("!reduce").Join(), t.Reduce))
+
+				// rebuild the view so the reduced value is computed from scratch.
+				// without a map function there are no rows, only a stale value.
+				if mapf == t.Map && t.Map != "" {
+					mapfUpdated = append(mapfUpdated, fupdated{path, t.Map})
+				} else if mapf == "" && t.Map == "" {
+					ops = append(ops, db.dropReducedValue(path)...)
+				}
 			}
 		}
 		proceed = true
@@ -96,7 +132,7 @@ func (db *SummaDB) Merge(p types.Path, t types.Tree) error {
 	if err == nil {
 		go func() {
 			for _, update := range mapfUpdated {
-				db.triggerChildrenMapUpdates(update.code, update.path)
+				db.rebuildView(update.code, update.path)
 			}
 
 			t.Recurse(p, func(p types.Path, _ types.Leaf, _ types.Tree) (proceed bool) {
@@ -104,8 +140,24 @@ func (db *SummaDB) Merge(p types.Path, t types.Tree) error {
 				proceed = true
 				return
 			})
+
+			db.triggerDependentMapFunctions(p)
 		}()
 	}
 
 	return err
 }
+
+// isElementsOnly tells if t has nothing but branches keyed by array indexes,
+// so it can be merged over an array without changing what it is.
+func isElementsOnly(t types.Tree) bool {
+	if t.Leaf.Kind != types.UNDEFINED {
+		return false
+	}
+	for k := range t.Branches {
+		if _, ok := types.ArrayIndex(k); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strconv"
+
+	"github.com/fiatjaf/levelup"
+)
+
+// MigrateReport tells what was copied by Migrate.
+type MigrateReport struct {
+	Keys          int    `json:"keys"`
+	Checksum      string `json:"checksum"`
+	LocalKeys     int    `json:"local_keys"`
+	LocalChecksum string `json:"local_checksum"`
+}
+
+// Migrate copies a whole database, with its local store, from one location
+// to another, each given as "<backend>:<path>", like "goleveldown:/var/summadb".
+// both stores at the destination must be empty, and nothing is written to any
+// of them otherwise. after copying, the keys at the destination are counted
+// and checksummed again and compared with the ones at the source.
+func Migrate(from, to string) (report MigrateReport, err error) {
+	frombackend, frompath, err := ParseLocation(from)
+	if err != nil {
+		return
+	}
+	tobackend, topath, err := ParseLocation(to)
+	if err != nil {
+		return
+	}
+
+	var stores []levelup.DB
+	defer func() {
+		for _, store := range stores {
+			store.Close()
+		}
+	}()
+	for _, location := range [][2]string{
+		{frombackend, frompath},
+		{frombackend, frompath + "_local"},
+		{tobackend, topath},
+		{tobackend, topath + "_local"},
+	} {
+		var store levelup.DB
+		store, err = openStore(location[0], location[1])
+		if err != nil {
+			return
+		}
+		stores = append(stores, store)
+	}
+	src, srclocal, dst, dstlocal := stores[0], stores[1], stores[2], stores[3]
+
+	for _, store := range []levelup.DB{dst, dstlocal} {
+		iter := store.ReadRange(&levelup.RangeOpts{Limit: 1})
+		empty := !iter.Valid()
+		iter.Release()
+		if !empty {
+			return report, errors.New("destination is not empty")
+		}
+	}
+
+	report.Keys, report.Checksum, err = copyStore(src, dst)
+	if err != nil {
+		return
+	}
+	report.LocalKeys, report.LocalChecksum, err = copyStore(srclocal, dstlocal)
+	return
+}
+
+// copyStore streams all keys from src to dst in batches, then checks
+// that dst has the same keys and values.
+func copyStore(src, dst levelup.DB) (count int, checksum string, err error) {
+	var ops []levelup.Operation
+	h := sha256.New()
+	iter := src.ReadRange(&levelup.RangeOpts{})
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			iter.Release()
+			return
+		}
+
+		// backends may reuse the memory of the keys and values they return
+		key := append([]byte(nil), iter.Key()...)
+		value := append([]byte(nil), iter.Value()...)
+		checksumPair(h, key, value)
+		count++
+
+		ops = append(ops, levelup.Put(key, value))
+		if len(ops) >= 1000 {
+			if err = dst.Batch(ops); err != nil {
+				iter.Release()
+				return
+			}
+			ops = ops[:0]
+		}
+	}
+	err = iter.Error()
+	iter.Release()
+	if err != nil {
+		return
+	}
+	if err = dst.Batch(ops); err != nil {
+		return
+	}
+	checksum = hex.EncodeToString(h.Sum(nil))
+
+	copied, copiedsum, err := storeChecksum(dst)
+	if err != nil {
+		return
+	}
+	if copied != count {
+		err = errors.New("copied " + strconv.Itoa(count) + " keys, but the destination has " +
+			strconv.Itoa(copied))
+		return
+	}
+	if copiedsum != checksum {
+		err = errors.New("checksum of the destination doesn't match the source")
+	}
+	return
+}
+
+// storeChecksum counts all keys in a store and hashes them with their values.
+func storeChecksum(store levelup.DB) (count int, checksum string, err error) {
+	h := sha256.New()
+	iter := store.ReadRange(&levelup.RangeOpts{})
+	defer iter.Release()
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			return
+		}
+		checksumPair(h, iter.Key(), iter.Value())
+		count++
+	}
+	if err = iter.Error(); err != nil {
+		return
+	}
+	return count, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func checksumPair(h hash.Hash, key, value []byte) {
+	var size [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(key)))
+	h.Write(size[:])
+	h.Write(key)
+	binary.BigEndian.PutUint64(size[:], uint64(len(value)))
+	h.Write(size[:])
+	h.Write(value)
+}
@@ -0,0 +1,198 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/memdown"
+	"github.com/summadb/summadb/types"
+	. "gopkg.in/check.v1"
+)
+
+// persistentMemory is a memdown that survives being closed,
+// so it can be opened again by path.
+type persistentMemory struct{ *memdown.Database }
+
+func (persistentMemory) Close() {}
+
+var memorystores = make(map[string]levelup.DB)
+var memorystoresmu sync.Mutex
+
+func init() {
+	RegisterBackend("testmemory", func(path string) levelup.DB {
+		memorystoresmu.Lock()
+		defer memorystoresmu.Unlock()
+		if _, ok := memorystores[path]; !ok {
+			memorystores[path] = persistentMemory{memdown.NewDatabase()}
+		}
+		return memorystores[path]
+	})
+}
+
+func (s *DatabaseSuite) TestMigrate(c *C) {
+	db, err := OpenBackend("testmemory", "source")
+	c.Assert(err, IsNil)
+	c.Assert(db.Set(types.Path{"food"}, types.Tree{
+		Branches: types.Branches{
+			"banana": &types.Tree{Leaf: types.StringLeaf("fruit")},
+			"yam":    &types.Tree{Leaf: types.StringLeaf("tuber")},
+		},
+		Map: `emit('by-kind', doc._val, _key)`,
+	}), IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	report, err := Migrate("testmemory:source", "testmemory:destination")
+	c.Assert(err, IsNil)
+	c.Assert(report.Keys > 0, Equals, true)
+	c.Assert(report.LocalKeys > 0, Equals, true)
+	c.Assert(report.Checksum, HasLen, 64)
+	c.Assert(report.Checksum, Not(Equals), report.LocalChecksum)
+
+	copied, err := OpenBackend("testmemory", "destination")
+	c.Assert(err, IsNil)
+	original, _ := db.Read(types.Path{"food"})
+	treeread, err := copied.Read(types.Path{"food"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Rev, Equals, original.Rev)
+	c.Assert(treeread.Branches["yam"].Leaf, DeepEquals, types.StringLeaf("tuber"))
+	treeread, err = copied.Read(types.Path{"food", "!map", "by-kind"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["fruit"].Leaf, DeepEquals, types.StringLeaf("banana"))
+	status, err := copied.ViewStatus(types.Path{"food"})
+	c.Assert(err, IsNil)
+	c.Assert(status.Documents, Equals, 2)
+
+	// the destination must be empty
+	_, err = Migrate("testmemory:source", "testmemory:destination")
+	c.Assert(err, ErrorMatches, "destination is not empty")
+
+	// both of its stores, or nothing is copied
+	other, err := OpenBackend("testmemory", "other")
+	c.Assert(err, IsNil)
+	c.Assert(other.local.Put("leftover", "1"), IsNil)
+	_, err = Migrate("testmemory:source", "testmemory:other")
+	c.Assert(err, ErrorMatches, "destination is not empty")
+	iter := memorystores["other"].ReadRange(&levelup.RangeOpts{})
+	c.Assert(iter.Valid(), Equals, false)
+	iter.Release()
+
+	_, err = Migrate("nobackend:source", "testmemory:other")
+	c.Assert(err, ErrorMatches, "unknown backend: nobackend.*")
+	_, err = Migrate("testmemory", "testmemory:other")
+	c.Assert(err, ErrorMatches, "location should be .*")
+}
+
+// closingMemory counts how many times it was closed.
+type closingMemory struct {
+	*memdown.Database
+	closed *int
+}
+
+func (m closingMemory) Close() { *m.closed++ }
+
+func (s *DatabaseSuite) TestOpenBackendClosesStores(c *C) {
+	closed := 0
+	RegisterBackend("testclosing", func(path string) levelup.DB {
+		store := closingMemory{memdown.NewDatabase(), &closed}
+		if strings.HasSuffix(path, "_local") {
+			store.Put([]byte("formatversion"), []byte(strconv.Itoa(formatVersion+1)))
+		}
+		return store
+	})
+
+	_, err := OpenBackend("testclosing", "newer")
+	c.Assert(err, FitsTypeOf, FormatError{})
+	c.Assert(closed, Equals, 2)
+}
+
+func (s *DatabaseSuite) TestUpgrade(c *C) {
+	// a database from when keys were raw and paths were joined by "/"
+	main := slu.StringDB(memdown.NewDatabase())
+	local := slu.StringDB(memdown.NewDatabase())
+	main.Put("docs/_rev", "1-aaaa")
+	main.Put("docs/a/_rev", "1-bbbb")
+	main.Put("docs/a", `"x"`)
+	main.Put("docs/100%/_rev", "1-dddd")
+	main.Put("docs/100%", `"full"`)
+	main.Put("docs/!map", `emit('all', _key, 1)`)
+	main.Put("docs/!map/all/a", "1")
+	main.Put("docs/!map/all/100%", "1")
+	main.Put("docs-2/_rev", "1-cccc")
+	main.Put("pets:old/!map", `emit('all', _key, 1)`)
+	main.Put("pets:old/tom:1/_rev", "1-eeee")
+	main.Put("pets:old/!map/all/tom:1", "1")
+	local.Put("mapped:docs:100%", "all/100%")
+	local.Put("mapped:pets:old:tom:1", "all/tom:1")
+
+	_, err := newSummaDB(main, local)
+	c.Assert(err, DeepEquals, FormatError{1, formatVersion})
+	version, _ := local.Get("formatversion")
+	c.Assert(version, Equals, "1")
+
+	// the upgrade was interrupted after some keys of the main store were encoded
+	c.Assert(encodeRawLocalKeys(main, local), IsNil)
+	main.Del("docs/a")
+	main.Put(encodeKey("docs/a"), `"x"`)
+
+	c.Assert(upgrade(main, local), IsNil)
+	db, err := newSummaDB(main, local)
+	c.Assert(err, IsNil)
+	treeread, err := db.Read(types.Path{"docs"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Rev, Equals, "1-aaaa")
+	c.Assert(treeread.Map, Equals, `emit('all', _key, 1)`)
+	c.Assert(treeread.Branches, HasLen, 2)
+	c.Assert(treeread.Branches["a"].Leaf, DeepEquals, types.StringLeaf("x"))
+	c.Assert(treeread.Branches["a"].Rev, Equals, "1-bbbb")
+	c.Assert(treeread.Branches[types.EscapeKey("100%")].Leaf, DeepEquals, types.StringLeaf("full"))
+	rows, err := db.Read(types.Path{"docs", "!map", "all"})
+	c.Assert(err, IsNil)
+	c.Assert(rows.Branches["a"].Leaf, DeepEquals, types.IntegerLeaf(1))
+	c.Assert(rows.Branches[types.EscapeKey("100%")].Leaf, DeepEquals, types.IntegerLeaf(1))
+
+	// the lists of rows are split where the view is, even with ":" on both sides
+	mapped, _ := local.Get(mappedKey(types.Path{"docs"}, types.EscapeKey("100%")))
+	c.Assert(mapped, Equals, "all/"+types.EscapeKey("100%"))
+	pets := types.Path{types.EscapeKey("pets:old")}
+	mapped, _ = local.Get(mappedKey(pets, types.EscapeKey("tom:1")))
+	c.Assert(mapped, Equals, "all/"+types.EscapeKey("tom:1"))
+	_, err = local.Get("mapped:pets:old:tom:1")
+	c.Assert(err, NotNil)
+	paths, err := db.ListViews()
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []types.Path{{"docs"}, pets})
+
+	// nothing to do anymore
+	c.Assert(upgrade(main, local), IsNil)
+	version, _ = local.Get("formatversion")
+	c.Assert(version, Equals, strconv.Itoa(formatVersion))
+
+	// new databases get the current version, newer ones are refused
+	main = slu.StringDB(memdown.NewDatabase())
+	local = slu.StringDB(memdown.NewDatabase())
+	_, err = newSummaDB(main, local)
+	c.Assert(err, IsNil)
+	version, _ = local.Get("formatversion")
+	c.Assert(version, Equals, strconv.Itoa(formatVersion))
+	local.Put("formatversion", strconv.Itoa(formatVersion+1))
+	_, err = newSummaDB(main, local)
+	c.Assert(err, ErrorMatches, ".* newer than format .*")
+	c.Assert(upgrade(main, local), Not(IsNil))
+
+	// through a backend
+	_, err = OpenBackend("testmemory", "old")
+	c.Assert(err, IsNil)
+	memorystores["old"].Put([]byte("docs/b"), []byte(`"y"`))
+	memorystores["old_local"].Put([]byte("formatversion"), []byte("1"))
+	_, err = OpenBackend("testmemory", "old")
+	c.Assert(err, DeepEquals, FormatError{1, formatVersion})
+	c.Assert(Upgrade("testmemory:old"), IsNil)
+	db, err = OpenBackend("testmemory", "old")
+	c.Assert(err, IsNil)
+	treeread, _ = db.Read(types.Path{"docs", "b"})
+	c.Assert(treeread.Leaf, DeepEquals, types.StringLeaf("y"))
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+)
+
+// Move relocates the tree at from to the path to, with its map and reduce
+// functions and the rows of its views, in a single batch. from is left
+// deleted, as by Delete, and everything at to gets new revs. rev must be
+// the current rev of from, and there must be nothing at to.
+func (db *SummaDB) Move(from, to types.Path, rev string) error {
+	var ops []levelup.Operation
+
+	// check if the paths are valid for mutating
+	if len(from) == 0 || !from.WriteValid() || from.InsideView() || isSpecialKey(from.Last()) {
+		return errors.New("cannot move invalid path: " + from.Join())
+	}
+	if len(to) == 0 || !to.WriteValid() || to.InsideView() || isSpecialKey(to.Last()) {
+		return errors.New("cannot move to invalid path: " + to.Join())
+	}
+	if len(to) >= len(from) && to[:len(from)].Equals(from) {
+		return errors.New("cannot move a path into itself: " + to.Join())
+	}
+
+	// check if the toplevel rev matches and cancel everything if it doesn't
+	if err := db.checkRev(rev, from); err != nil {
+		return err
+	}
+	if _, err := db.Get(from.Child("_del").Join()); err == nil {
+		return errors.New("cannot move deleted path: " + from.Join())
+	}
+	if _, err := db.Get(to.Child("_rev").Join()); err == nil {
+		if _, err := db.Get(to.Child("_del").Join()); err != nil {
+			return errors.New("cannot move to existing path: " + to.Join())
+		}
+	}
+
+	destination := func(path types.Path) types.Path {
+		return append(to.Copy(), path.RelativeTo(from)...)
+	}
+
+	// the whole subtree must be known before anything is moved, since
+	// the deletion markers of a path may come after its children.
+	type entry struct {
+		path  types.Path
+		value string
+	}
+	var entries []entry
+	alreadyDeleted := make(map[string]bool)
+	iter := db.ReadRange(&slu.RangeOpts{
+		Start: from.Join(),
+		End:   from.Join() + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		if err := iter.Error(); err != nil {
+			iter.Release()
+			return err
+		}
+
+		path := types.ParsePath(iter.Key())
+		if path.Last() == "_del" {
+			alreadyDeleted[path.Parent().Join()] = true
+			continue
+		}
+		entries = append(entries, entry{path, iter.Value()})
+	}
+	iter.Release()
+
+	// store all revs to bump in a map and bump them all at once
+	revsToBump := make(map[string]string)
+
+	// views defined anywhere in the subtree, by their map functions
+	movedViews := make(map[string]string)
+
+	for _, e := range entries {
+		path := e.path
+
+		switch path.Last() {
+		case "_rev":
+			// paths already deleted stay where they are
+			node := path.Parent()
+			if alreadyDeleted[node.Join()] {
+				continue
+			}
+
+			// bump the rev at the source, and at the destination start
+			// over, unless something was deleted there before
+			revsToBump[node.Join()] = e.value
+			dest := destination(node)
+			destrev, _ := db.Get(dest.Child("_rev").Join())
+			revsToBump[dest.Join()] = destrev
+
+			// undelete
+			ops = append(ops, slu.Del(dest.Child("_del").Join()))
+		default:
+			if path.Last() == "!map" && e.value != "" {
+				movedViews[path.Parent().Join()] = e.value
+			}
+
+			ops = append(ops,
+				slu.Del(path.Join()),
+				slu.Put(destination(path).Join(), e.value),
+			)
+
+			if path.IsLeaf() {
+				// mark it as deleted
+				ops = append(ops, slu.Put(path.Child("_del").Join(), "1"))
+			}
+		}
+	}
+
+	// the rows and reduced values of the moved views go with them,
+	// so they can be read at the destination right away
+	viewiter := db.readKeyspaces([]string{viewSpace}, &slu.RangeOpts{
+		Start: from.Join(),
+		End:   from.Join() + rangeEnd,
+	})
+	for ; viewiter.Valid(); viewiter.Next() {
+		if err := viewiter.Error(); err != nil {
+			viewiter.Release()
+			return err
+		}
+
+		path := types.ParsePath(viewiter.Key())
+		ops = append(ops,
+			slu.Del(path.Join()),
+			slu.Put(destination(path).Join(), viewiter.Value()),
+		)
+	}
+	viewiter.Release()
+
+	// gather all revs in ancestors of both paths, all them should be bumped
+	for _, p := range []types.Path{from, to} {
+		son := p.Copy()
+		for parent := son.Parent(); !parent.Equals(son); parent = son.Parent() {
+			rev, _ := db.Get(parent.Child("_rev").Join())
+			revsToBump[parent.Join()] = rev
+			son = parent
+		}
+	}
+
+	// finally, the source path should be deleted
+	ops = append(ops, slu.Put(from.Child("_del").Join(), "1"))
+
+	// bump revs
+	for leafpath, oldrev := range revsToBump {
+		p := types.ParsePath(leafpath)
+		newrev := bumpRev(oldrev)
+		ops = append(ops, slu.Put(p.Child("_rev").Join(), newrev))
+	}
+
+	// write
+	err := db.Batch(ops)
+
+	if err == nil {
+		go func() {
+			// clear what is known about the rows at the old place
+			// and map everything again at the new one
+			for viewpath, mapf := range movedViews {
+				db.rebuildView("", types.ParsePath(viewpath))
+				db.rebuildView(mapf, destination(types.ParsePath(viewpath)))
+			}
+
+			// both the old and new ancestors have changed
+			db.triggerAncestorMapFunctions(from)
+			db.triggerAncestorMapFunctions(to)
+			db.triggerDependentMapFunctions(from)
+			db.triggerDependentMapFunctions(to)
+		}()
+	}
+
+	return err
+}
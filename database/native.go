@@ -0,0 +1,104 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/summadb/summadb/types"
+	"github.com/summadb/summadb/views"
+)
+
+// MapFunc is a map function written in Go. It gets the same arguments a lua
+// map function gets as globals: the document, its key and the 'emit' function.
+type MapFunc func(doc types.Tree, key string, emit func(types.Path, types.Tree))
+
+// ReduceFunc is a reduce function written in Go. It must return the new
+// accumulated value, like a lua reduce function leaves it in 'acc'.
+type ReduceFunc func(directive string, acc types.Tree, row types.EmittedRow, key string) types.Tree
+
+var native = struct {
+	sync.RWMutex
+	maps    map[string]MapFunc
+	reduces map[string]ReduceFunc
+}{
+	maps:    make(map[string]MapFunc),
+	reduces: make(map[string]ReduceFunc),
+}
+
+// RegisterMap makes f available to be used as a map function by any path
+// whose "!map" is "#!go <name>".
+func RegisterMap(name string, f MapFunc) {
+	native.Lock()
+	defer native.Unlock()
+	native.maps[name] = f
+}
+
+// RegisterReduce makes f available to be used as a reduce function by any path
+// whose "!reduce" is "#!go <name>".
+func RegisterReduce(name string, f ReduceFunc) {
+	native.Lock()
+	defer native.Unlock()
+	native.reduces[name] = f
+}
+
+// execMap runs mapf, whatever its language is. env is used by map functions
+// that read other records or libraries.
+func execMap(mapf string, tree types.Tree, key string, env views.Env) (emitted []types.EmittedRow, err error) {
+	lang, body := views.Language(mapf)
+	if lang != views.GO {
+		return views.MapEnv(context.Background(), mapf, tree, key, env)
+	}
+
+	name := strings.TrimSpace(body)
+	native.RLock()
+	f, ok := native.maps[name]
+	native.RUnlock()
+	if !ok {
+		return nil, errors.New("no Go map function registered as " + name)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			emitted = nil
+			err = fmt.Errorf("Go map function %s panicked: %v", name, r)
+		}
+	}()
+	f(tree, key, func(relpath types.Path, value types.Tree) {
+		emitted = append(emitted, types.EmittedRow{RelativePath: relpath, Value: value})
+	})
+	return emitted, nil
+}
+
+// execReduce runs reducef, whatever its language is.
+func execReduce(
+	reducef string,
+	directive string,
+	acc types.Tree,
+	row types.EmittedRow,
+	key string,
+	env views.Env,
+) (result types.Tree, err error) {
+	lang, body := views.Language(reducef)
+	if lang != views.GO {
+		return views.ReduceEnv(context.Background(), reducef, directive, acc, row, key, env)
+	}
+
+	name := strings.TrimSpace(body)
+	native.RLock()
+	f, ok := native.reduces[name]
+	native.RUnlock()
+	if !ok {
+		return types.Tree{}, errors.New("no Go reduce function registered as " + name)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			result = types.Tree{}
+			err = fmt.Errorf("Go reduce function %s panicked: %v", name, r)
+		}
+	}()
+	return f(directive, acc, row, key), nil
+}
@@ -0,0 +1,19 @@
+// +build !levelupjs
+
+package database
+
+import "errors"
+
+// Open opens the database at dbpath with the first of the storage engines
+// built in, which are chosen with the goleveldown, rocksdown or sqlitedown
+// build tags. databases in an older format must be upgraded first, with Upgrade.
+func Open(dbpath string) (*SummaDB, error) {
+	backendsmu.Lock()
+	backend := defaultBackend
+	backendsmu.Unlock()
+	if backend == "" {
+		return nil, errors.New("no storage backend built in, use the goleveldown, rocksdown or sqlitedown tags")
+	}
+
+	return OpenBackend(backend, dbpath)
+}
@@ -4,11 +4,9 @@ package database
 
 import (
 	"github.com/fiatjaf/goleveldown"
-	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/fiatjaf/levelup"
 )
 
-func Open(dbpath string) *SummaDB {
-	db := slu.StringDB(goleveldown.NewDatabase(dbpath))
-	local := slu.StringDB(goleveldown.NewDatabase(dbpath + "_local"))
-	return &SummaDB{db, local}
+func init() {
+	RegisterBackend("goleveldown", func(path string) levelup.DB { return goleveldown.NewDatabase(path) })
 }
@@ -7,8 +7,8 @@ import (
 	slu "github.com/fiatjaf/levelup/stringlevelup"
 )
 
-func Open(dbpath string, adapterName string) *SummaDB {
+func Open(dbpath string, adapterName string) (*SummaDB, error) {
 	db := slu.StringDB(levelupjs.NewDatabase(dbpath, adapterName))
 	local := slu.StringDB(levelupjs.NewDatabase(dbpath+"_local", adapterName))
-	return &SummaDB{db, local}
+	return newSummaDB(db, local)
 }
@@ -0,0 +1,19 @@
+package database
+
+import (
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/memdown"
+)
+
+// OpenMemory opens a new database that is kept only in memory,
+// so everything in it is gone when it is closed.
+func OpenMemory() *SummaDB {
+	db := slu.StringDB(memdown.NewDatabase())
+	local := slu.StringDB(memdown.NewDatabase())
+	summadb, err := newSummaDB(db, local)
+	if err != nil {
+		// new databases are always in the current format
+		panic(err)
+	}
+	return summadb
+}
@@ -3,12 +3,10 @@
 package database
 
 import (
-	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/fiatjaf/levelup"
 	"github.com/fiatjaf/rocksdown"
 )
 
-func Open(dbpath string) *SummaDB {
-	db := slu.StringDB(rocksdown.NewDatabase(dbpath))
-	local := slu.StringDB(rocksdown.NewDatabase(dbpath + "_local"))
-	return &SummaDB{db, local}
+func init() {
+	RegisterBackend("rocksdown", func(path string) levelup.DB { return rocksdown.NewDatabase(path) })
 }
@@ -0,0 +1,12 @@
+// +build sqlitedown
+
+package database
+
+import (
+	"github.com/fiatjaf/levelup"
+	"github.com/summadb/summadb/sqlitedown"
+)
+
+func init() {
+	RegisterBackend("sqlitedown", func(path string) levelup.DB { return sqlitedown.NewDatabase(path) })
+}
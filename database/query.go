@@ -2,6 +2,7 @@ package database
 
 import (
 	"errors"
+	"strconv"
 
 	slu "github.com/fiatjaf/levelup/stringlevelup"
 	"github.com/summadb/summadb/types"
@@ -12,6 +13,10 @@ type QueryParams struct {
 	KeyEnd     string
 	Descending bool
 	Limit      int
+
+	// only for queries on the rows of a view (paths under a "!map"):
+	// attach to each record the document that emitted it.
+	IncludeDocs bool
 }
 
 // Query provide a querying interface similar to CouchDB, in which you can manually specify
@@ -19,13 +24,75 @@ type QueryParams struct {
 // in contrast with Read, which returns a big tree of everything under the given path,
 // Query return an array of trees, as the children of the given path.
 func (db *SummaDB) Query(sourcepath types.Path, params QueryParams) (records []*types.Tree, err error) {
+	if !params.IncludeDocs {
+		return db.query(sourcepath, params)
+	}
+
+	// the rows and the documents that emitted them are read with nothing
+	// being written in between.
+	db.snapshotmu.Lock()
+	defer db.snapshotmu.Unlock()
+
+	records, err = db.query(sourcepath, params)
+	if err != nil {
+		return
+	}
+	err = db.includeDocs(sourcepath, records)
+	return
+}
+
+// includeDocs sets the Doc of each record that is a row emitted by a map function
+// to the document that emitted it, as recorded in the lists of rows emitted by
+// each document.
+func (db *SummaDB) includeDocs(sourcepath types.Path, records []*types.Tree) error {
+	// find the view these rows belong to
+	mapindex := -1
+	for i, key := range sourcepath {
+		if key == "!map" {
+			mapindex = i
+		}
+	}
+	if mapindex == -1 {
+		return errors.New("can only include docs when querying a view: " + sourcepath.Join())
+	}
+	viewpath := sourcepath[:mapindex]
+	rowpath := sourcepath[mapindex+1:]
+
+	emitted, err := db.emittedRows(viewpath)
+	if err != nil {
+		return err
+	}
+
+	docs := make(map[string]*types.Tree)
+	for _, record := range records {
+		docid, ok := emitted[rowpath.Child(record.Key).Join()]
+		if !ok {
+			// not a row, but a path containing rows
+			continue
+		}
+
+		doc, ok := docs[docid]
+		if !ok {
+			tree, err := db.Read(docPath(viewpath, docid))
+			if err != nil {
+				return err
+			}
+			doc = &tree
+			docs[docid] = doc
+		}
+		record.Doc = doc
+	}
+	return nil
+}
+
+func (db *SummaDB) query(sourcepath types.Path, params QueryParams) (records []*types.Tree, err error) {
 	if !sourcepath.ReadValid() {
 		return records, errors.New("cannot read invalid path: " + sourcepath.Join())
 	}
 
 	rangeopts := slu.RangeOpts{
 		Start:   sourcepath.Child("").Join(),
-		End:     sourcepath.Child("~~~").Join(),
+		End:     sourcepath.Join() + rangeEnd,
 		Reverse: params.Descending,
 	}
 	if params.KeyStart != "" {
@@ -108,6 +175,10 @@ func (db *SummaDB) Query(sourcepath types.Path, params QueryParams) (records []*
 				switch key {
 				case "_rev":
 					currentbranch.Rev = value
+				case "!mapdepth":
+					if i == len(relpath)-1 {
+						currentbranch.MapDepth, _ = strconv.Atoi(value)
+					}
 				case "!map":
 					if i == len(relpath)-1 {
 						// grab the code for the map function, never any of its results
@@ -118,6 +189,8 @@ func (db *SummaDB) Query(sourcepath types.Path, params QueryParams) (records []*
 						// grab the code for the reduce function, never any of its results
 						currentbranch.Reduce = value
 					}
+				case "_arr":
+					currentbranch.Array = true
 				case "_del":
 					currentbranch.Deleted = true
 					if i == 0 {
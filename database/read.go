@@ -2,7 +2,7 @@ package database
 
 import (
 	"errors"
-	"strings"
+	"strconv"
 
 	slu "github.com/fiatjaf/levelup/stringlevelup"
 	"github.com/summadb/summadb/types"
@@ -13,17 +13,12 @@ func (db *SummaDB) Read(sourcepath types.Path) (types.Tree, error) {
 		return types.Tree{}, errors.New("cannot read invalid path: " + sourcepath.Join())
 	}
 
-	// if we're reading /a/path/like/this/!reduce, don't read the code for the reducef
-	if sourcepath.Last() == "!reduce" {
-		sourcepath = append(sourcepath, "")
-	}
-
 	var err error
 	tree := types.NewTree()
 
 	iter := db.ReadRange(&slu.RangeOpts{
 		Start: sourcepath.Join(),
-		End:   sourcepath.Join() + "~~~",
+		End:   sourcepath.Join() + rangeEnd,
 	})
 	defer iter.Release()
 	for ; iter.Valid(); iter.Next() {
@@ -33,11 +28,6 @@ func (db *SummaDB) Read(sourcepath types.Path) (types.Tree, error) {
 
 		rawpath := iter.Key()
 
-		// skip all rows emitted from !map functions
-		if strings.Index(rawpath, "/!map/") != -1 && rawpath == "!map" {
-			continue
-		}
-
 		path := types.ParsePath(rawpath)
 		relpath := path.RelativeTo(sourcepath)
 
@@ -71,11 +61,17 @@ func (db *SummaDB) Read(sourcepath types.Path) (types.Tree, error) {
 				switch key {
 				case "_rev":
 					currentbranch.Rev = value
+				case "!mapdepth":
+					if i == len(relpath)-1 {
+						currentbranch.MapDepth, _ = strconv.Atoi(value)
+					}
 				case "!map":
 					if i == len(relpath)-1 {
 						// grab the code for the map function, never any of its results
 						currentbranch.Map = value
 					}
+				case "_arr":
+					currentbranch.Array = true
 				case "_del":
 					currentbranch.Deleted = true
 				default:
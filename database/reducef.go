@@ -34,14 +34,19 @@ func (db *SummaDB) runReduce(
 	}
 
 	// actually run the reduce function
-	result, err := views.Reduce(reducef, directive, current, emitted, key)
+	rec := &recorder{db: db}
+	result, err := execReduce(reducef, directive, current, emitted, key, views.Env{
+		Require: libraryLoader(base, rec.get),
+	})
+	db.addDependencies(base, "!reduce", rec.paths)
 	if err != nil {
-		log.Error("views.Reduce returned error.",
+		log.Error("reduce function returned error.",
 			"err", err,
 			"base", base,
 			"reducef", reducef,
 			"emitted", emitted,
 			"key", key)
+		db.saveViewError(base, key, "reduce", err)
 		return err
 	}
 
@@ -49,24 +54,38 @@ func (db *SummaDB) runReduce(
 }
 
 func (db *SummaDB) updateReduceValueInTheDatabase(reducepath types.Path, old types.Tree, new types.Tree) error {
-	var ops []levelup.Operation
+	return db.Batch(reduceValueOps(reducepath, old, new))
+}
 
+// reduceValueOps returns the operations that replace the reduced value
+// old with new.
+func reduceValueOps(reducepath types.Path, old types.Tree, new types.Tree) (ops []levelup.Operation) {
+	// the key at reducepath itself holds the code of the reduce function,
+	// so the reduced value can only be stored in its branches.
 	old.Recurse(reducepath,
 		func(p types.Path, leaf types.Leaf, t types.Tree) (proceed bool) {
-			ops = append(ops, slu.Del(p.Join()))
+			if !p.Equals(reducepath) {
+				ops = append(ops, slu.Del(p.Join()))
+			}
+			if t.Array {
+				ops = append(ops, slu.Del(p.Child("_arr").Join()))
+			}
 			proceed = true
 			return
 		})
 
 	new.Recurse(reducepath,
 		func(p types.Path, leaf types.Leaf, t types.Tree) (proceed bool) {
-			if leaf.Kind != types.NULL {
+			if leaf.Kind != types.NULL && !p.Equals(reducepath) {
 				jsonvalue, _ := leaf.MarshalJSON()
 				ops = append(ops, slu.Put(p.Join(), string(jsonvalue)))
 			}
+			if t.Array {
+				ops = append(ops, slu.Put(p.Child("_arr").Join(), "1"))
+			}
 			proceed = true
 			return
 		})
 
-	return db.Batch(ops)
+	return ops
 }
@@ -33,7 +33,7 @@ func (p PathRev) MarshalJSON() ([]byte, error) {
 func (r Replicator) AllRevs() (revs []PathRev, err error) {
 	iter := r.db.ReadRange(&slu.RangeOpts{
 		Start: r.path.Join(),
-		End:   r.path.Join() + "~~~",
+		End:   r.path.Join() + rangeEnd,
 	})
 	defer iter.Release()
 	for ; iter.Valid(); iter.Next() {
@@ -7,7 +7,7 @@ import (
 )
 
 func (s *DatabaseSuite) TestAllRevs(c *C) {
-	db := Open("/tmp/summadb-test-allrevs")
+	db := OpenMemory()
 	defer db.Erase()
 
 	rpl := Replicator{db, types.Path{"subdb"}}
@@ -96,7 +96,7 @@ func (s *DatabaseSuite) TestAllRevs(c *C) {
 }
 
 func (s *DatabaseSuite) TestRevsDiff(c *C) {
-	db := Open("/tmp/summadb-test-revsdiff")
+	db := OpenMemory()
 	defer db.Erase()
 
 	rpl1 := Replicator{db, types.Path{"sub1"}}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"errors"
+	"strconv"
 
 	"github.com/fiatjaf/levelup"
 	slu "github.com/fiatjaf/levelup/stringlevelup"
@@ -16,6 +17,11 @@ func (db *SummaDB) Set(p types.Path, t types.Tree) error {
 		return errors.New("cannot set on invalid path: " + p.Join())
 	}
 
+	// view rows can only get map and reduce functions
+	if p.InsideView() {
+		return db.setViewFunctions(p, t)
+	}
+
 	// check if the toplevel rev matches and cancel everything if it doesn't
 	if err := db.checkRev(t.Rev, p); err != nil {
 		return err
@@ -24,9 +30,13 @@ func (db *SummaDB) Set(p types.Path, t types.Tree) error {
 	// store all revs to bump in a map and bump them all at once
 	revsToBump := make(map[string]string)
 
+	// views whose map or reduce functions are being removed
+	removedMaps := make(map[string]bool)
+	removedReduces := make(map[string]bool)
+
 	iter := db.ReadRange(&slu.RangeOpts{
 		Start: p.Join(),
-		End:   p.Join() + "~~~",
+		End:   p.Join() + rangeEnd,
 	})
 	defer iter.Release()
 	for ; iter.Valid(); iter.Next() {
@@ -36,6 +46,13 @@ func (db *SummaDB) Set(p types.Path, t types.Tree) error {
 		case "_rev":
 			revsToBump[path.Parent().Join()] = iter.Value()
 		default:
+			switch path.Last() {
+			case "!map":
+				removedMaps[path.Parent().Join()] = true
+			case "!reduce":
+				removedReduces[path.Parent().Join()] = true
+			}
+
 			// drop the value at this path (it doesn't matter,
 			// we're deleting everything besides _rev and _del)
 			ops = append(ops, slu.Del(path.Join()))
@@ -78,20 +95,30 @@ func (db *SummaDB) Set(p types.Path, t types.Tree) error {
 			// undelete
 			ops = append(ops, slu.Del(path.Child("_del").Join()))
 
+			// mark arrays, so their branches are read back as elements
+			if t.Array {
+				ops = append(ops, slu.Put(path.Child("_arr").Join(), "1"))
+			}
+
 			// save the map function if provided
 			if t.Map != "" {
 				ops = append(ops, slu.Put(path.Child("!map").Join(), t.Map))
+				if t.MapDepth > 1 {
+					ops = append(ops, slu.Put(path.Child("!mapdepth").Join(), strconv.Itoa(t.MapDepth)))
+				}
 
-				// trigger map computations for all direct children of this key
+				// trigger map computations for all direct children of this key,
+				// which also computes the reduced value from scratch
 				mapfUpdated = append(mapfUpdated, fupdated{path, t.Map})
+				delete(removedMaps, path.Join())
+				delete(removedReduces, path.Join())
 			}
 
-			// save the reduce function if provided
+			// save the reduce function if provided. without a map function
+			// there are no rows to reduce, so there's nothing to rebuild.
 			if t.Reduce != "" {
 				ops = append(ops, slu.Put(path.Child("!reduce").Join(), t.Reduce))
-
-				// trigger map computations for all direct children of this key
-				mapfUpdated = append(mapfUpdated, fupdated{path.Parent(), t.Map}) // yes, map.
+				delete(removedReduces, path.Join())
 			}
 
 			proceed = true
@@ -99,6 +126,16 @@ func (db *SummaDB) Set(p types.Path, t types.Tree) error {
 		}
 	})
 
+	// the rows and reduced values of the removed views aren't in the range above
+	for viewpath := range removedMaps {
+		ops = append(ops, db.dropViewRows(types.ParsePath(viewpath))...)
+	}
+	for viewpath := range removedReduces {
+		if !removedMaps[viewpath] {
+			ops = append(ops, db.dropReducedValue(types.ParsePath(viewpath))...)
+		}
+	}
+
 	// bump revs
 	for leafpath, oldrev := range revsToBump {
 		p := types.ParsePath(leafpath)
@@ -112,9 +149,13 @@ func (db *SummaDB) Set(p types.Path, t types.Tree) error {
 	if err == nil {
 		go func() {
 			for _, update := range mapfUpdated {
-				db.triggerChildrenMapUpdates(update.code, update.path)
+				db.rebuildView(update.code, update.path)
+			}
+			for viewpath := range removedMaps {
+				db.rebuildView("", types.ParsePath(viewpath))
 			}
 			db.triggerAncestorMapFunctions(p)
+			db.triggerDependentMapFunctions(p)
 		}()
 	}
 
@@ -0,0 +1,148 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+)
+
+// Stats tells how much is stored in a subtree.
+type Stats struct {
+	Path        string       `json:"path"`
+	Nodes       int          `json:"nodes"`      // paths with a value, a rev or a deletion marker
+	Leaves      int          `json:"leaves"`     // nodes with a value
+	Tombstones  int          `json:"tombstones"` // nodes marked as deleted
+	ValueBytes  int64        `json:"value_bytes"`
+	ViewBytes   int64        `json:"view_bytes"` // rows and reduced values of all views in the subtree
+	DeepestPath string       `json:"deepest_path"`
+	Largest     []ChildStats `json:"largest,omitempty"`
+}
+
+// ChildStats tells how much is stored under a child of the path given to
+// Stats. the rows and reduced values of the view defined at the path itself
+// are counted in the "!map" and "!reduce" children.
+type ChildStats struct {
+	Key   string `json:"key"`
+	Nodes int    `json:"nodes"`
+	Bytes int64  `json:"bytes"`
+}
+
+// Stats counts the nodes, leaves and deleted nodes in the tree at p, the bytes
+// its keys and values take, and the ones the views inside it take. it also
+// lists the top children that take the most bytes.
+func (db *SummaDB) Stats(p types.Path, top int) (stats Stats, err error) {
+	if !p.ReadValid() || p.InsideView() {
+		return stats, errors.New("cannot get stats for invalid path: " + p.Join())
+	}
+	if top < 0 {
+		return stats, errors.New("cannot list a negative number of children: " + strconv.Itoa(top))
+	}
+	stats.Path = p.Join()
+
+	children := make(map[string]*ChildStats)
+	count := func(relpath types.Path, bytes int64, node bool) {
+		if len(relpath) == 0 {
+			return
+		}
+		child, ok := children[relpath[0]]
+		if !ok {
+			child = &ChildStats{Key: relpath[0]}
+			children[relpath[0]] = child
+		}
+		child.Bytes += bytes
+		if node {
+			child.Nodes++
+		}
+	}
+
+	nodes := make(map[string]bool)
+	deepest := -1
+	node := func(path types.Path) bool {
+		if nodes[path.Join()] {
+			return false
+		}
+		nodes[path.Join()] = true
+		stats.Nodes++
+		if len(path) > deepest {
+			deepest = len(path)
+			stats.DeepestPath = path.Join()
+		}
+		return true
+	}
+
+	iter := db.readKeyspaces([]string{dataSpace, metaSpace}, &slu.RangeOpts{
+		Start: p.Join(),
+		End:   p.Join() + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			iter.Release()
+			return stats, err
+		}
+
+		key := iter.Key()
+		bytes := int64(len(encodeKey(key)) + len(iter.Value()))
+		stats.ValueBytes += bytes
+
+		path := types.ParsePath(key)
+		isnode := false
+		switch path.Last() {
+		case "_rev":
+			path = path.Parent()
+			isnode = node(path)
+		case "_del":
+			path = path.Parent()
+			isnode = node(path)
+			stats.Tombstones++
+		case "_arr", "!map", "!mapdepth", "!reduce":
+			path = path.Parent()
+		default:
+			isnode = node(path)
+			// branches may be stored with an empty value
+			if iter.Value() != "" {
+				stats.Leaves++
+			}
+		}
+		count(path.RelativeTo(p), bytes, isnode)
+	}
+	iter.Release()
+
+	iter = db.readKeyspaces([]string{viewSpace}, &slu.RangeOpts{
+		Start: p.Join(),
+		End:   p.Join() + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			iter.Release()
+			return stats, err
+		}
+
+		key := iter.Key()
+		bytes := int64(len(encodeKey(key)) + len(iter.Value()))
+		stats.ViewBytes += bytes
+		count(types.ParsePath(key).RelativeTo(p), bytes, false)
+	}
+	iter.Release()
+
+	stats.Largest = make([]ChildStats, 0, len(children))
+	for _, child := range children {
+		stats.Largest = append(stats.Largest, *child)
+	}
+	sort.Slice(stats.Largest, func(i, j int) bool {
+		if stats.Largest[i].Bytes != stats.Largest[j].Bytes {
+			return stats.Largest[i].Bytes > stats.Largest[j].Bytes
+		}
+		return stats.Largest[i].Key < stats.Largest[j].Key
+	})
+	if len(stats.Largest) > top {
+		stats.Largest = stats.Largest[:top]
+	}
+	if len(stats.Largest) == 0 {
+		stats.Largest = nil
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,99 @@
+package database
+
+import (
+	"sort"
+	"time"
+
+	"github.com/summadb/summadb/types"
+	"github.com/summadb/summadb/views"
+)
+
+type TestViewParams struct {
+	Map    string
+	Reduce string
+
+	// the documents to run the functions on, by key.
+	// if none are given, the first Limit children of Path are used.
+	Docs  types.Branches
+	Path  types.Path
+	Limit int
+}
+
+type TestViewRow struct {
+	Key   string     `json:"key"` // the key of the document that emitted this row
+	Path  types.Path `json:"path"`
+	Value types.Tree `json:"value"`
+}
+
+type TestViewResult struct {
+	Rows   []TestViewRow `json:"rows"`
+	Reduce types.Tree    `json:"reduce"`
+	Errors []ViewError   `json:"errors"`
+}
+
+// TestView runs map and reduce functions on some documents without storing
+// anything, so they can be tried before being written to the database.
+func (db *SummaDB) TestView(params TestViewParams) (result TestViewResult, err error) {
+	result.Rows = []TestViewRow{}
+	result.Errors = []ViewError{}
+
+	docs := params.Docs
+	if len(docs) == 0 {
+		limit := params.Limit
+		if limit == 0 {
+			limit = 10
+		}
+		records, err := db.Query(params.Path, QueryParams{Limit: limit})
+		if err != nil {
+			return result, err
+		}
+		docs = make(types.Branches, len(records))
+		for _, record := range records {
+			docs[record.Key] = record
+		}
+	}
+
+	keys := make([]string, 0, len(docs))
+	for key := range docs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fail := func(key string, function string, err error) {
+		result.Errors = append(result.Errors, ViewError{
+			Path:      params.Path.Child(key).Join(),
+			Function:  function,
+			Error:     err.Error(),
+			Timestamp: time.Now().UTC(),
+		})
+	}
+
+	for _, key := range keys {
+		emittedrows, err := execMap(params.Map, *docs[key], key, views.Env{
+			Get:     db.Read,
+			Require: libraryLoader(params.Path, db.Read),
+		})
+		if err != nil {
+			fail(key, "map", err)
+			continue
+		}
+
+		for _, row := range emittedrows {
+			result.Rows = append(result.Rows, TestViewRow{key, row.RelativePath, row.Value})
+
+			if params.Reduce == "" {
+				continue
+			}
+			reduced, err := execReduce(params.Reduce, "add", result.Reduce, row, key, views.Env{
+				Require: libraryLoader(params.Path, db.Read),
+			})
+			if err != nil {
+				fail(key, "reduce", err)
+				continue
+			}
+			result.Reduce = reduced
+		}
+	}
+
+	return
+}
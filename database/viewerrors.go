@@ -0,0 +1,110 @@
+package database
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+)
+
+// ViewError is the last error a map or reduce function threw
+// when processing a document.
+type ViewError struct {
+	Path      string    `json:"path"`     // the path of the document
+	Function  string    `json:"function"` // "map" or "reduce"
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// errors are stored at "viewerror:<viewpath>//<function>//<docid>". joined
+// paths never have "//" in them, so the parts can't be confused, and the
+// errors of a view are never mixed with the ones of views inside it.
+func viewErrorKey(viewpath types.Path, function string, docid string) string {
+	return viewErrorPrefix(viewpath, function) + docid
+}
+
+func viewErrorPrefix(viewpath types.Path, function string) string {
+	prefix := "viewerror:" + viewpath.Join() + "//"
+	if function != "" {
+		prefix += function + "//"
+	}
+	return prefix
+}
+
+// ViewErrors returns the errors of all documents that failed to be mapped
+// or reduced by the view at the given path.
+func (db *SummaDB) ViewErrors(viewpath types.Path) (viewerrors []ViewError, err error) {
+	prefix := viewErrorPrefix(viewpath, "")
+	iter := db.local.ReadRange(&slu.RangeOpts{
+		Start: prefix,
+		End:   prefix + rangeEnd,
+	})
+	defer iter.Release()
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			return
+		}
+
+		var viewerror ViewError
+		if err = json.Unmarshal([]byte(iter.Value()), &viewerror); err != nil {
+			return
+		}
+		viewerrors = append(viewerrors, viewerror)
+	}
+	return
+}
+
+// saveViewError stores the error a function threw for docid, replacing
+// any previous one.
+func (db *SummaDB) saveViewError(viewpath types.Path, docid string, function string, ferr error) {
+	value, _ := json.Marshal(ViewError{
+		Path:      docPath(viewpath, docid).Join(),
+		Function:  function,
+		Error:     ferr.Error(),
+		Timestamp: time.Now().UTC(),
+	})
+	err := db.local.Put(viewErrorKey(viewpath, function, docid), string(value))
+	if err != nil {
+		log.Error("failed to store view error.",
+			"err", err,
+			"viewpath", viewpath,
+			"docid", docid,
+			"ferr", ferr)
+	}
+}
+
+// clearViewError removes the error function stored for docid, if any.
+func (db *SummaDB) clearViewError(viewpath types.Path, function string, docid string) {
+	err := db.local.Del(viewErrorKey(viewpath, function, docid))
+	if err != nil {
+		log.Error("failed to clear view error.",
+			"err", err,
+			"viewpath", viewpath,
+			"function", function,
+			"docid", docid)
+	}
+}
+
+// clearViewErrors removes the errors function stored for all documents.
+func (db *SummaDB) clearViewErrors(viewpath types.Path, function string) {
+	prefix := viewErrorPrefix(viewpath, function)
+	var ops []levelup.Operation
+	iter := db.local.ReadRange(&slu.RangeOpts{
+		Start: prefix,
+		End:   prefix + rangeEnd,
+	})
+	for ; iter.Valid(); iter.Next() {
+		ops = append(ops, slu.Del(iter.Key()))
+	}
+	iter.Release()
+
+	err := db.local.Batch(ops)
+	if err != nil {
+		log.Error("failed to clear view errors.",
+			"err", err,
+			"viewpath", viewpath,
+			"function", function)
+	}
+}
@@ -1,15 +1,17 @@
 package database
 
 import (
+	"sort"
 	"time"
 
 	"github.com/summadb/summadb/types"
 	. "github.com/summadb/summadb/utils"
+	"github.com/summadb/summadb/views"
 	. "gopkg.in/check.v1"
 )
 
 func (s *DatabaseSuite) TestMapFunctions(c *C) {
-	db := Open("/tmp/summadb-test-mapf")
+	db := OpenMemory()
 	defer db.Erase()
 
 	// insert a tree with a map function
@@ -173,9 +175,7 @@ emit('by-size', food.size._val, food)
 }
 
 func (s *DatabaseSuite) TestReduceFunctions(c *C) {
-	db := Open("/tmp/summadb-test-reducef")
-	db.Erase()
-	db = Open("/tmp/summadb-test-reducef")
+	db := OpenMemory()
 
 	mapf := `
 for word in string.gmatch(doc._val, "%S+") do
@@ -244,3 +244,813 @@ end
 	c.Assert(records[2].Branches["next"].Leaf, DeepEquals, types.StringLeaf("você"))
 	c.Assert(records[2].Branches["count"].Leaf, DeepEquals, types.NumberLeaf(1))
 }
+
+func (s *DatabaseSuite) TestReducedValueKeepsCode(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	reducef := `
+local kind = path[1]
+local count = acc[kind] and acc[kind]._val or 0
+if directive == "add" then count = count + 1 else count = count - 1 end
+acc[kind] = count
+    `
+	err = db.Set(types.Path{"things"}, types.Tree{
+		Map:    `emit(doc._val, 1)`,
+		Reduce: reducef,
+		Branches: types.Branches{
+			"a": &types.Tree{Leaf: types.StringLeaf("rock")},
+			"b": &types.Tree{Leaf: types.StringLeaf("paper")},
+			"c": &types.Tree{Leaf: types.StringLeaf("rock")},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	// the reduced value is stored under the code, not over it
+	code, err := db.Get("things/!reduce")
+	c.Assert(err, IsNil)
+	c.Assert(code, Equals, reducef)
+
+	treeread, err := db.Read(types.Path{"things", "!reduce"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2)
+	c.Assert(treeread.Branches["rock"].Leaf.Number(), Equals, float64(2))
+	c.Assert(treeread.Branches["paper"].Leaf.Number(), Equals, float64(1))
+}
+
+func (s *DatabaseSuite) TestSetReplacesFunctions(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	docs := types.Branches{
+		"a": &types.Tree{Leaf: types.StringLeaf("rock")},
+		"b": &types.Tree{Leaf: types.StringLeaf("paper")},
+	}
+	reducef := `acc.count = (acc.count and acc.count._val or 0) + 1`
+	err = db.Set(types.Path{"things"}, types.Tree{
+		Map:      `emit(doc._val, 1)`,
+		Reduce:   reducef,
+		Branches: docs,
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+	reduced, _ := db.Read(types.Path{"things", "!reduce"})
+	c.Assert(reduced.Branches["count"].Leaf.Number(), Equals, float64(2))
+
+	// without the reduce function the rows stay, but not the reduced value
+	rev, _ := db.Rev(types.Path{"things"})
+	err = db.Set(types.Path{"things"}, types.Tree{
+		Rev:      rev,
+		Map:      `emit(doc._val, 1)`,
+		Branches: docs,
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+	row, _ := db.Read(types.Path{"things", "!map", "rock"})
+	c.Assert(row.Leaf.Number(), Equals, float64(1))
+	reduced, _ = db.Read(types.Path{"things", "!reduce"})
+	c.Assert(reduced.Branches, HasLen, 0)
+
+	// and a reduce function alone has no rows to reduce
+	rev, _ = db.Rev(types.Path{"things"})
+	err = db.Set(types.Path{"things"}, types.Tree{
+		Rev:      rev,
+		Reduce:   reducef,
+		Branches: docs,
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+	row, _ = db.Read(types.Path{"things", "!map", "rock"})
+	c.Assert(row.Leaf.Kind, Equals, byte(types.UNDEFINED))
+	reduced, _ = db.Read(types.Path{"things", "!reduce"})
+	c.Assert(reduced.Branches, HasLen, 0)
+	code, _ := db.Get("things/!reduce")
+	c.Assert(code, Equals, reducef)
+}
+
+func (s *DatabaseSuite) TestNativeFunctions(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	RegisterMap("by-kind", func(doc types.Tree, key string, emit func(types.Path, types.Tree)) {
+		if kind, ok := doc.Branches["kind"]; ok {
+			emit(types.Path{"by-kind", kind.Leaf.String(), key}, types.Tree{Leaf: types.BoolLeaf(true)})
+		}
+	})
+	RegisterReduce("count", func(directive string, acc types.Tree, row types.EmittedRow, key string) types.Tree {
+		kind := row.RelativePath[1]
+		count, ok := acc.Branches[kind]
+		if !ok {
+			count = &types.Tree{}
+		}
+		n := count.Leaf.Number()
+		if directive == "add" {
+			n++
+		} else {
+			n--
+		}
+		if acc.Branches == nil {
+			acc.Branches = types.Branches{}
+		}
+		acc.Branches[kind] = &types.Tree{Leaf: types.NumberLeaf(n)}
+		return acc
+	})
+
+	err = db.Set(types.Path{"things"}, types.Tree{
+		Map:    "#!go by-kind",
+		Reduce: "#!go count",
+		Branches: types.Branches{
+			"a": &types.Tree{Branches: types.Branches{"kind": &types.Tree{Leaf: types.StringLeaf("rock")}}},
+			"b": &types.Tree{Branches: types.Branches{"kind": &types.Tree{Leaf: types.StringLeaf("paper")}}},
+			"c": &types.Tree{Branches: types.Branches{"kind": &types.Tree{Leaf: types.StringLeaf("rock")}}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err := db.Read(types.Path{"things", "!map", "by-kind"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2)
+	c.Assert(treeread.Branches["rock"].Branches, HasLen, 2)
+	c.Assert(treeread.Branches["paper"].Branches["b"].Leaf, DeepEquals, types.BoolLeaf(true))
+
+	treeread, err = db.Read(types.Path{"things", "!reduce"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["rock"].Leaf.Number(), Equals, float64(2))
+	c.Assert(treeread.Branches["paper"].Leaf.Number(), Equals, float64(1))
+
+	// unregistered names emit nothing
+	rows, err := execMap("#!go nonexistent", types.Tree{}, "x", views.Env{})
+	c.Assert(err, ErrorMatches, "no Go map function registered as nonexistent")
+	c.Assert(rows, HasLen, 0)
+}
+
+func (s *DatabaseSuite) TestViewErrors(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	err = db.Set(types.Path{"people"}, types.Tree{
+		Map: `emit("by-name", doc.name._val, true)`,
+		Branches: types.Branches{
+			"a": &types.Tree{Branches: types.Branches{"name": &types.Tree{Leaf: types.StringLeaf("maria")}}},
+			"b": &types.Tree{Branches: types.Branches{"age": &types.Tree{Leaf: types.NumberLeaf(23)}}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	// 'b' has no name, so the map function fails on it
+	viewerrors, err := db.ViewErrors(types.Path{"people"})
+	c.Assert(err, IsNil)
+	c.Assert(viewerrors, HasLen, 1)
+	c.Assert(viewerrors[0].Path, Equals, "people/b")
+	c.Assert(viewerrors[0].Function, Equals, "map")
+	c.Assert(viewerrors[0].Error, Matches, "(?s).*attempt to index.*")
+	c.Assert(viewerrors[0].Timestamp.IsZero(), Equals, false)
+
+	// the error is cleared once the document maps successfully
+	err = db.Set(types.Path{"people", "b", "name"}, types.Tree{Leaf: types.StringLeaf("joão")})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	viewerrors, err = db.ViewErrors(types.Path{"people"})
+	c.Assert(err, IsNil)
+	c.Assert(viewerrors, HasLen, 0)
+
+	treeread, err := db.Read(types.Path{"people", "!map", "by-name"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2)
+
+	// map and reduce errors of the same document are kept apart
+	err = db.Set(types.Path{"pets"}, types.Tree{
+		Map:    `if doc.bad then error("bad") end emit("all", _key, 1)`,
+		Reduce: `error("nope")`,
+		Branches: types.Branches{
+			"rex": &types.Tree{Branches: types.Branches{"kind": &types.Tree{Leaf: types.StringLeaf("dog")}}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+	err = db.Set(types.Path{"pets", "rex", "bad"}, types.Tree{Leaf: types.BoolLeaf(true)})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	viewerrors, err = db.ViewErrors(types.Path{"pets"})
+	c.Assert(err, IsNil)
+	c.Assert(viewerrors, HasLen, 2)
+	functions := []string{viewerrors[0].Function, viewerrors[1].Function}
+	sort.Strings(functions)
+	c.Assert(functions, DeepEquals, []string{"map", "reduce"})
+
+	// and the ones of a view with ":" in its path aren't taken as of another
+	err = db.Set(types.Path{"pets:old"}, types.Tree{
+		Map: `error("old")`,
+		Branches: types.Branches{
+			"tom": &types.Tree{Leaf: types.StringLeaf("cat")},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	viewerrors, err = db.ViewErrors(types.Path{"pets"})
+	c.Assert(err, IsNil)
+	c.Assert(viewerrors, HasLen, 2)
+	viewerrors, err = db.ViewErrors(types.Path{"pets:old"})
+	c.Assert(err, IsNil)
+	c.Assert(viewerrors, HasLen, 1)
+	c.Assert(viewerrors[0].Path, Equals, "pets:old/tom")
+}
+
+func (s *DatabaseSuite) TestViewStatus(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	err = db.Set(types.Path{}, types.Tree{
+		Branches: types.Branches{
+			"people": &types.Tree{
+				Map: `for _, tag in ipairs({"x", "y"}) do emit(tag, _key, doc.name._val) end`,
+				Branches: types.Branches{
+					"a": &types.Tree{Branches: types.Branches{"name": &types.Tree{Leaf: types.StringLeaf("maria")}}},
+					"b": &types.Tree{Branches: types.Branches{"name": &types.Tree{Leaf: types.StringLeaf("joão")}}},
+					"c": &types.Tree{Leaf: types.NumberLeaf(3)},
+				},
+			},
+			"places": &types.Tree{
+				Branches: types.Branches{
+					"cities": &types.Tree{Reduce: `acc._val = 0`},
+				},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	paths, err := db.ListViews()
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []types.Path{{"people"}, {"places", "cities"}})
+
+	status, err := db.ViewStatus(types.Path{"people"})
+	c.Assert(err, IsNil)
+	c.Assert(status.Path, Equals, "people")
+	c.Assert(status.Map, Matches, "for _, tag.*")
+	c.Assert(status.Reduce, Equals, "")
+	c.Assert(status.Rows, Equals, 4)
+	c.Assert(status.Documents, Equals, 2)
+	c.Assert(status.Pending, Equals, 0)
+	c.Assert(status.Errors, Equals, 1 /* 'c' has no name */)
+	c.Assert(time.Since(status.LastUpdate) < time.Minute, Equals, true)
+
+	// views leave the list when their functions are removed or deleted
+	rev, _ := db.Rev(types.Path{"places", "cities"})
+	err = db.Merge(types.Path{"places", "cities"}, types.Tree{Rev: rev, Reduce: "", Map: `emit(_key, 1)`})
+	c.Assert(err, IsNil)
+	rev, _ = db.Rev(types.Path{"people"})
+	err = db.Delete(types.Path{"people"}, rev)
+	c.Assert(err, IsNil)
+	paths, err = db.ListViews()
+	c.Assert(err, IsNil)
+	c.Assert(paths, DeepEquals, []types.Path{{"places", "cities"}})
+	_, err = db.local.Get(viewIndexKey(types.Path{"people"}))
+	c.Assert(err, NotNil)
+}
+
+func (s *DatabaseSuite) TestTestView(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	mapf := `emit("by-size", doc.size._val, _key)`
+	reducef := `acc._val = (acc._val or 0) + value._val`
+
+	// sample documents
+	result, err := db.TestView(TestViewParams{
+		Map:    mapf,
+		Reduce: `acc._val = (acc._val or 0) + 1`,
+		Docs: types.Branches{
+			"a": &types.Tree{Branches: types.Branches{"size": &types.Tree{Leaf: types.NumberLeaf(3)}}},
+			"b": &types.Tree{Branches: types.Branches{"size": &types.Tree{Leaf: types.NumberLeaf(5)}}},
+			"c": &types.Tree{Leaf: types.StringLeaf("no size")},
+		},
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result.Rows, HasLen, 2)
+	c.Assert(result.Rows[0].Key, Equals, "a")
+	c.Assert(result.Rows[0].Path, DeepEquals, types.Path{"by-size", "3"})
+	c.Assert(result.Rows[1].Value.Leaf, DeepEquals, types.StringLeaf("b"))
+	c.Assert(result.Reduce.Leaf, DeepEquals, types.NumberLeaf(2))
+	c.Assert(result.Errors, HasLen, 1)
+	c.Assert(result.Errors[0].Path, Equals, "c")
+	c.Assert(result.Errors[0].Function, Equals, "map")
+
+	// documents from the database
+	err = db.Set(types.Path{"things"}, types.Tree{
+		Branches: types.Branches{
+			"x": &types.Tree{Branches: types.Branches{"size": &types.Tree{Leaf: types.NumberLeaf(1)}}},
+			"y": &types.Tree{Branches: types.Branches{"size": &types.Tree{Leaf: types.NumberLeaf(2)}}},
+			"z": &types.Tree{Branches: types.Branches{"size": &types.Tree{Leaf: types.NumberLeaf(4)}}},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	result, err = db.TestView(TestViewParams{
+		Map:    `emit("sizes", _key, doc.size._val)`,
+		Reduce: reducef,
+		Path:   types.Path{"things"},
+		Limit:  2,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result.Rows, HasLen, 2)
+	c.Assert(result.Reduce.Leaf, DeepEquals, types.NumberLeaf(3))
+	c.Assert(result.Errors, HasLen, 0)
+
+	// as when no documents come in a request
+	result, err = db.TestView(TestViewParams{
+		Map:   `emit("sizes", _key, doc.size._val)`,
+		Docs:  types.Branches{},
+		Path:  types.Path{"things"},
+		Limit: 2,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(result.Rows, HasLen, 2)
+
+	// nothing was written
+	time.Sleep(time.Millisecond * 100)
+	paths, err := db.ListViews()
+	c.Assert(err, IsNil)
+	c.Assert(paths, HasLen, 0)
+	treeread, err := db.Read(types.Path{"things", "!map", "by-size"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 0)
+}
+
+func (s *DatabaseSuite) TestViewRebuild(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	err = db.Set(types.Path{"items"}, types.Tree{
+		Map: `emit("v1", _key, true)`,
+		Branches: types.Branches{
+			"a": &types.Tree{Leaf: types.NumberLeaf(1)},
+			"b": &types.Tree{Leaf: types.NumberLeaf(2)},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	// a map function that waits until we let it go
+	gate := make(chan bool)
+	RegisterMap("gated", func(doc types.Tree, key string, emit func(types.Path, types.Tree)) {
+		<-gate
+		emit(types.Path{"v2", key}, types.Tree{Leaf: types.BoolLeaf(true)})
+	})
+
+	rev, _ := db.Rev(types.Path{"items"})
+	err = db.Merge(types.Path{"items"}, types.Tree{Rev: rev, Map: "#!go gated"})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 100)
+
+	// old rows are still served while the new ones are built
+	treeread, err := db.Read(types.Path{"items", "!map", "v1"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2)
+	treeread, err = db.Read(types.Path{"items", "!map", "v2"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 0)
+
+	progress, building := db.BuildProgress(types.Path{"items"})
+	c.Assert(building, Equals, true)
+	c.Assert(progress.Total, Equals, 2)
+	c.Assert(progress.Done, Equals, 0)
+
+	// a document added during the build is included in it
+	err = db.Set(types.Path{"items", "c"}, types.Tree{Leaf: types.NumberLeaf(3)})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 100)
+
+	status, err := db.ViewStatus(types.Path{"items"})
+	c.Assert(err, IsNil)
+	c.Assert(status.Build, Not(IsNil))
+	c.Assert(status.Build.Total, Equals, 3)
+	c.Assert(status.Rows, Equals, 2)
+
+	close(gate)
+	time.Sleep(time.Millisecond * 200)
+
+	_, building = db.BuildProgress(types.Path{"items"})
+	c.Assert(building, Equals, false)
+
+	treeread, err = db.Read(types.Path{"items", "!map", "v1"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 0)
+	treeread, err = db.Read(types.Path{"items", "!map", "v2"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 3)
+
+	status, err = db.ViewStatus(types.Path{"items"})
+	c.Assert(err, IsNil)
+	c.Assert(status.Build, IsNil)
+	c.Assert(status.Rows, Equals, 3)
+	c.Assert(status.Documents, Equals, 3)
+	c.Assert(status.Pending, Equals, 0)
+}
+
+func (s *DatabaseSuite) TestMapDependencies(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	err = db.Set(types.Path{}, types.Tree{
+		Branches: types.Branches{
+			"customers": &types.Tree{
+				Branches: types.Branches{
+					"maria": &types.Tree{Branches: types.Branches{"city": &types.Tree{Leaf: types.StringLeaf("recife")}}},
+					"joão":  &types.Tree{Branches: types.Branches{"city": &types.Tree{Leaf: types.StringLeaf("natal")}}},
+				},
+			},
+		},
+	})
+	c.Assert(err, IsNil)
+
+	err = db.Set(types.Path{"orders"}, types.Tree{
+		Map: `
+local customer = get("customers/" .. doc.customer._val)
+if customer ~= nil then
+  emit("by-city", customer.city._val, _key, true)
+end
+        `,
+		Branches: types.Branches{
+			"1": &types.Tree{Branches: types.Branches{"customer": &types.Tree{Leaf: types.StringLeaf("maria")}}},
+			"2": &types.Tree{Branches: types.Branches{"customer": &types.Tree{Leaf: types.StringLeaf("joão")}}},
+			"3": &types.Tree{Branches: types.Branches{"customer": &types.Tree{Leaf: types.StringLeaf("zé")}}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err := db.Read(types.Path{"orders", "!map", "by-city"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2)
+	c.Assert(treeread.Branches["recife"].Branches["1"].Leaf, DeepEquals, types.BoolLeaf(true))
+
+	// the customer moves, the order follows
+	rev, _ := db.Rev(types.Path{"customers", "maria", "city"})
+	err = db.Set(types.Path{"customers", "maria", "city"}, types.Tree{Rev: rev, Leaf: types.StringLeaf("natal")})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"orders", "!map", "by-city"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 1)
+	c.Assert(treeread.Branches["natal"].Branches, HasLen, 2)
+
+	// a customer that didn't exist when the order was mapped
+	err = db.Set(types.Path{"customers", "zé"}, types.Tree{
+		Branches: types.Branches{"city": &types.Tree{Leaf: types.StringLeaf("olinda")}},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"orders", "!map", "by-city", "olinda"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["3"].Leaf, DeepEquals, types.BoolLeaf(true))
+
+	// views and documents with ":" in their paths
+	mapf, _ := db.Get("orders/!map")
+	err = db.Set(types.Path{"orders:old"}, types.Tree{
+		Map: mapf,
+		Branches: types.Branches{
+			"a:1": &types.Tree{Branches: types.Branches{"customer": &types.Tree{Leaf: types.StringLeaf("maria")}}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+	rev, _ = db.Rev(types.Path{"customers", "maria", "city"})
+	err = db.Set(types.Path{"customers", "maria", "city"}, types.Tree{Rev: rev, Leaf: types.StringLeaf("caruaru")})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"orders:old", "!map", "by-city"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 1)
+	c.Assert(treeread.Branches["caruaru"].Branches["a:1"].Leaf, DeepEquals, types.BoolLeaf(true))
+
+	// deleting all customers
+	rev, _ = db.Rev(types.Path{"customers"})
+	err = db.Delete(types.Path{"customers"}, rev)
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"orders", "!map", "by-city"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 0)
+}
+
+func (s *DatabaseSuite) TestLibraries(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	err = db.Set(types.Path{"!lib", "money"}, types.Tree{Leaf: types.StringLeaf(`
+local M = {}
+function M.cents(v) return v * 100 end
+return M
+    `)})
+	c.Assert(err, IsNil)
+
+	err = db.Set(types.Path{"sales"}, types.Tree{
+		Map: `emit("cents", _key, require("money").cents(doc.value._val))`,
+		Reduce: `
+local total = acc.total and acc.total._val or 0
+if directive == "remove" then
+  acc.total = total - value._val + require("money").cents(0)
+else
+  acc.total = total + value._val + require("money").cents(0)
+end
+        `,
+		Branches: types.Branches{
+			"a": &types.Tree{Branches: types.Branches{"value": &types.Tree{Leaf: types.NumberLeaf(2)}}},
+			"b": &types.Tree{Branches: types.Branches{"value": &types.Tree{Leaf: types.NumberLeaf(3)}}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err := db.Read(types.Path{"sales", "!map", "cents"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["a"].Leaf, DeepEquals, types.NumberLeaf(200))
+	treeread, err = db.Read(types.Path{"sales", "!reduce"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["total"].Leaf, DeepEquals, types.NumberLeaf(500))
+
+	// libraries have revs like everything else
+	rev, err := db.Rev(types.Path{"!lib", "money"})
+	c.Assert(err, IsNil)
+	c.Assert(rev, StartsWith, "1-")
+
+	// changing the library changes the view
+	err = db.Set(types.Path{"!lib", "money"}, types.Tree{Rev: rev, Leaf: types.StringLeaf(`
+return {cents = function (v) return v * 1000 end}
+    `)})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"sales", "!map", "cents"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["a"].Leaf, DeepEquals, types.NumberLeaf(2000))
+	c.Assert(treeread.Branches["b"].Leaf, DeepEquals, types.NumberLeaf(3000))
+	treeread, err = db.Read(types.Path{"sales", "!reduce"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["total"].Leaf, DeepEquals, types.NumberLeaf(5000))
+
+	// a library closer to the view takes precedence
+	err = db.Set(types.Path{"sales", "!lib", "money"}, types.Tree{Leaf: types.StringLeaf(`
+return {cents = function (v) return v end}
+    `)})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"sales", "!map", "cents"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2)
+	c.Assert(treeread.Branches["a"].Leaf, DeepEquals, types.NumberLeaf(2))
+}
+
+func (s *DatabaseSuite) TestIncludeDocs(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	err = db.Set(types.Path{"people"}, types.Tree{
+		Map: `emit("by-age", doc.age._val, doc.name._val)`,
+		Branches: types.Branches{
+			"m": &types.Tree{Branches: types.Branches{
+				"name": &types.Tree{Leaf: types.StringLeaf("maria")},
+				"age":  &types.Tree{Leaf: types.NumberLeaf(31)},
+			}},
+			"j": &types.Tree{Branches: types.Branches{
+				"name": &types.Tree{Leaf: types.StringLeaf("joão")},
+				"age":  &types.Tree{Leaf: types.NumberLeaf(27)},
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	records, err := db.Query(types.Path{"people", "!map", "by-age"}, QueryParams{IncludeDocs: true})
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[0].Key, Equals, "27")
+	c.Assert(records[0].Leaf, DeepEquals, types.StringLeaf("joão"))
+	c.Assert(records[0].Doc, Not(IsNil))
+	c.Assert(records[0].Doc.Key, Equals, "j")
+	c.Assert(records[0].Doc.Branches["age"].Leaf, DeepEquals, types.NumberLeaf(27))
+	c.Assert(records[1].Doc.Branches["name"].Leaf, DeepEquals, types.StringLeaf("maria"))
+
+	json, err := records[1].MarshalJSON()
+	c.Assert(err, IsNil)
+	c.Assert(string(json), Matches, `.*"_doc":\{.*"maria".*`)
+
+	// without the option there are no docs
+	records, err = db.Query(types.Path{"people", "!map", "by-age"}, QueryParams{})
+	c.Assert(err, IsNil)
+	c.Assert(records[0].Doc, IsNil)
+
+	// the row changes owner when the document changes
+	rev, _ := db.Rev(types.Path{"people", "m", "age"})
+	err = db.Set(types.Path{"people", "m", "age"}, types.Tree{Rev: rev, Leaf: types.NumberLeaf(27)})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	records, err = db.Query(types.Path{"people", "!map", "by-age"}, QueryParams{IncludeDocs: true})
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 1)
+	c.Assert(records[0].Doc.Key, Equals, "m")
+
+	// only views have docs
+	_, err = db.Query(types.Path{"people"}, QueryParams{IncludeDocs: true})
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *DatabaseSuite) TestMapDepth(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	post := func(title string) *types.Tree {
+		return &types.Tree{Branches: types.Branches{"title": &types.Tree{Leaf: types.StringLeaf(title)}}}
+	}
+
+	err = db.Set(types.Path{"users"}, types.Tree{
+		Map:      `emit("by-title", doc.title._val, _key)`,
+		MapDepth: 3,
+		Branches: types.Branches{
+			"maria": &types.Tree{Branches: types.Branches{
+				"posts": &types.Tree{Branches: types.Branches{"1": post("hello"), "2": post("bye")}},
+			}},
+			"joão": &types.Tree{Branches: types.Branches{
+				"posts": &types.Tree{Branches: types.Branches{"1": post("hi")}},
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err := db.Read(types.Path{"users"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.MapDepth, Equals, 3)
+
+	// docids are paths relative to the view
+	treeread, err = db.Read(types.Path{"users", "!map", "by-title"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 3)
+	c.Assert(treeread.Branches["hello"].Leaf, DeepEquals, types.StringLeaf("maria/posts/1"))
+	c.Assert(treeread.Branches["hi"].Leaf, DeepEquals, types.StringLeaf("joão/posts/1"))
+
+	// changes deep inside a document
+	rev, _ := db.Rev(types.Path{"users", "maria", "posts", "2", "title"})
+	err = db.Set(types.Path{"users", "maria", "posts", "2", "title"}, types.Tree{Rev: rev, Leaf: types.StringLeaf("ciao")})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"users", "!map", "by-title"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 3)
+	c.Assert(treeread.Branches["ciao"].Leaf, DeepEquals, types.StringLeaf("maria/posts/2"))
+
+	// changes above the documents
+	rev, _ = db.Rev(types.Path{"users", "maria"})
+	err = db.Set(types.Path{"users", "maria"}, types.Tree{
+		Rev: rev,
+		Branches: types.Branches{
+			"posts": &types.Tree{Branches: types.Branches{"3": post("new")}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"users", "!map", "by-title"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2 /* 'hi' and 'new' */)
+	c.Assert(treeread.Branches["new"].Leaf, DeepEquals, types.StringLeaf("maria/posts/3"))
+
+	records, err := db.Query(types.Path{"users", "!map", "by-title"}, QueryParams{IncludeDocs: true})
+	c.Assert(err, IsNil)
+	c.Assert(records, HasLen, 2)
+	c.Assert(records[1].Doc.Branches["title"].Leaf, DeepEquals, types.StringLeaf("new"))
+
+	// merging a tree that doesn't set the depth keeps it
+	rev, _ = db.Rev(types.Path{"users"})
+	err = db.Merge(types.Path{"users"}, types.Tree{
+		Rev: rev,
+		Map: `emit("by-title", doc.title._val, _key)`,
+		Branches: types.Branches{
+			"ana": &types.Tree{Branches: types.Branches{
+				"posts": &types.Tree{Branches: types.Branches{"1": post("oi")}},
+			}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"users"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.MapDepth, Equals, 3)
+	treeread, err = db.Read(types.Path{"users", "!map", "by-title"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 3)
+	c.Assert(treeread.Branches["oi"].Leaf, DeepEquals, types.StringLeaf("ana/posts/1"))
+}
+
+func (s *DatabaseSuite) TestChainedViews(c *C) {
+	db := OpenMemory()
+	defer db.Erase()
+
+	err = db.Set(types.Path{"food"}, types.Tree{
+		Map: `emit("by-kind", doc.kind._val, _key, doc.size._val)`,
+		Branches: types.Branches{
+			"apple":  &types.Tree{Branches: types.Branches{"kind": &types.Tree{Leaf: types.StringLeaf("fruit")}, "size": &types.Tree{Leaf: types.NumberLeaf(10)}}},
+			"potato": &types.Tree{Branches: types.Branches{"kind": &types.Tree{Leaf: types.StringLeaf("tuber")}, "size": &types.Tree{Leaf: types.NumberLeaf(12)}}},
+			"carrot": &types.Tree{Branches: types.Branches{"kind": &types.Tree{Leaf: types.StringLeaf("tuber")}, "size": &types.Tree{Leaf: types.NumberLeaf(17)}}},
+		},
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	// a view over the rows of 'by-kind': each kind is a document
+	err = db.Set(types.Path{"food", "!map", "by-kind"}, types.Tree{
+		Map: `
+local total = 0
+for name, size in pairs(doc) do
+  if name ~= "_val" then total = total + size._val end
+end
+emit("total-size", _key, total)
+        `,
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err := db.Read(types.Path{"food", "!map", "by-kind", "!map", "total-size"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 2)
+	c.Assert(treeread.Branches["tuber"].Leaf, DeepEquals, types.NumberLeaf(29))
+	c.Assert(treeread.Branches["fruit"].Leaf, DeepEquals, types.NumberLeaf(10))
+
+	// the rows are still there, with the function
+	treeread, err = db.Read(types.Path{"food", "!map", "by-kind"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["tuber"].Branches, HasLen, 2)
+	c.Assert(treeread.Map, Not(Equals), "")
+
+	// changes propagate downstream
+	err = db.Set(types.Path{"food", "yam"}, types.Tree{
+		Branches: types.Branches{"kind": &types.Tree{Leaf: types.StringLeaf("tuber")}, "size": &types.Tree{Leaf: types.NumberLeaf(1)}},
+	})
+	c.Assert(err, IsNil)
+	rev, _ := db.Rev(types.Path{"food", "apple"})
+	err = db.Delete(types.Path{"food", "apple"}, rev)
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 300)
+
+	treeread, err = db.Read(types.Path{"food", "!map", "by-kind", "!map", "total-size"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches, HasLen, 1)
+	c.Assert(treeread.Branches["tuber"].Leaf, DeepEquals, types.NumberLeaf(30))
+
+	// and survive a rebuild of the upstream view
+	rev, _ = db.Rev(types.Path{"food"})
+	err = db.Merge(types.Path{"food"}, types.Tree{
+		Rev: rev,
+		Map: `emit("by-kind", doc.kind._val, _key, doc.size._val * 2)`,
+	})
+	c.Assert(err, IsNil)
+	time.Sleep(time.Millisecond * 300)
+
+	treeread, err = db.Read(types.Path{"food", "!map", "by-kind", "!map", "total-size"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["tuber"].Leaf, DeepEquals, types.NumberLeaf(60))
+
+	// the functions are changed with the current rev, like any other value,
+	// which is bumped along with the revs of the ancestors
+	rev, _ = db.Rev(types.Path{"food", "!map", "by-kind"})
+	c.Assert(rev, Not(Equals), "")
+	foodrev, _ := db.Rev(types.Path{"food"})
+	err = db.Merge(types.Path{"food", "!map", "by-kind"}, types.Tree{Map: `emit("count", _key, 1)`})
+	c.Assert(err, ErrorMatches, "mismatched revs .*")
+	err = db.Merge(types.Path{"food", "!map", "by-kind"}, types.Tree{Rev: rev, Map: `emit("count", _key, 1)`})
+	c.Assert(err, IsNil)
+	newrev, _ := db.Rev(types.Path{"food", "!map", "by-kind"})
+	c.Assert(newrev, Not(Equals), rev)
+	newrev, _ = db.Rev(types.Path{"food"})
+	c.Assert(newrev, Not(Equals), foodrev)
+	time.Sleep(time.Millisecond * 200)
+
+	treeread, err = db.Read(types.Path{"food", "!map", "by-kind", "!map", "count"})
+	c.Assert(err, IsNil)
+	c.Assert(treeread.Branches["tuber"].Leaf, DeepEquals, types.NumberLeaf(1))
+
+	// functions are set through the rows they are defined on
+	err = db.Set(types.Path{"food", "!map", "by-kind", "!map"}, types.Tree{Map: `emit("count", _key, 1)`})
+	c.Assert(err, Not(IsNil))
+
+	// rows themselves can't be written
+	err = db.Set(types.Path{"food", "!map", "by-kind", "tuber"}, types.Tree{Leaf: types.NumberLeaf(1)})
+	c.Assert(err, Not(IsNil))
+	err = db.Delete(types.Path{"food", "!map", "by-kind"}, "")
+	c.Assert(err, Not(IsNil))
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/fiatjaf/levelup"
+	slu "github.com/fiatjaf/levelup/stringlevelup"
+	"github.com/summadb/summadb/types"
+)
+
+// ViewStatus summarizes the state of the map and reduce functions at a path.
+type ViewStatus struct {
+	Path       string    `json:"path"`
+	Map        string    `json:"map,omitempty"`
+	Reduce     string    `json:"reduce,omitempty"`
+	Rows       int       `json:"rows"`      // rows currently emitted by the map function
+	Documents  int       `json:"documents"` // documents that emitted at least one row
+	Pending    int       `json:"pending"`   // documents waiting to be mapped
+	LastUpdate time.Time `json:"last_update"`
+	Errors     int       `json:"errors"`
+
+	// the progress of the background build, when the view is being rebuilt
+	Build *BuildProgress `json:"build,omitempty"`
+}
+
+// the paths of all views are kept in the local store at "view:<viewpath>",
+// so they can be listed without going through the whole database.
+func viewIndexKey(viewpath types.Path) string {
+	return "view:" + viewpath.Join()
+}
+
+// Batch writes ops to the main store, see batch.
+func (db *SummaDB) Batch(ops []levelup.Operation) error {
+	db.snapshotmu.RLock()
+	defer db.snapshotmu.RUnlock()
+	return db.batch(ops)
+}
+
+// batch writes ops to the main store, keeping the index of views up to date
+// with the map and reduce functions they set or remove. views are added to
+// the index before their functions are written and removed after, so if the
+// process dies in between the index can only have views that don't exist
+// anymore, which ListViews skips.
+func (db *SummaDB) batch(ops []levelup.Operation) error {
+	changed := make(map[string]types.Path)
+	var added []levelup.Operation
+	for _, op := range ops {
+		path := types.ParsePath(string(op.Key))
+		if last := path.Last(); last != "!map" && last != "!reduce" {
+			continue
+		}
+		viewpath := path.Parent()
+		changed[viewpath.Join()] = viewpath
+		if op.Type == "put" && len(op.Value) > 0 {
+			added = append(added, slu.Put(viewIndexKey(viewpath), ""))
+		}
+	}
+
+	if len(added) > 0 {
+		if err := db.local.Batch(added); err != nil {
+			return err
+		}
+	}
+	if err := db.pathDB.Batch(ops); err != nil {
+		return err
+	}
+
+	var removed []levelup.Operation
+	for _, viewpath := range changed {
+		if !db.isView(viewpath) {
+			removed = append(removed, slu.Del(viewIndexKey(viewpath)))
+		}
+	}
+	if len(removed) > 0 {
+		if err := db.local.Batch(removed); err != nil {
+			log.Error("failed to remove views from the index.",
+				"err", err)
+		}
+	}
+	return nil
+}
+
+// isView tells if there's a map or a reduce function at viewpath.
+func (db *SummaDB) isView(viewpath types.Path) bool {
+	mapf, _ := db.Get(viewpath.Child("!map").Join())
+	reducef, _ := db.Get(viewpath.Child("!reduce").Join())
+	return mapf != "" || reducef != ""
+}
+
+// ListViews returns the paths of all trees that have a map or a reduce function.
+func (db *SummaDB) ListViews() (paths []types.Path, err error) {
+	iter := db.local.ReadRange(&slu.RangeOpts{
+		Start: "view:",
+		End:   "view:" + rangeEnd,
+	})
+	defer iter.Release()
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			return
+		}
+
+		viewpath := types.ParsePath(strings.TrimPrefix(iter.Key(), "view:"))
+		if db.isView(viewpath) {
+			paths = append(paths, viewpath)
+		}
+	}
+	return
+}
+
+// ViewStatus gathers the code, row counts, pending updates, last update time
+// and number of errors of the view at the given path.
+func (db *SummaDB) ViewStatus(viewpath types.Path) (status ViewStatus, err error) {
+	status.Path = viewpath.Join()
+	status.Map, _ = db.Get(viewpath.Child("!map").Join())
+	status.Reduce, _ = db.Get(viewpath.Child("!reduce").Join())
+
+	prefix := mappedPrefix(viewpath)
+	iter := db.local.ReadRange(&slu.RangeOpts{
+		Start: prefix,
+		End:   prefix + rangeEnd,
+	})
+	defer iter.Release()
+	for ; iter.Valid(); iter.Next() {
+		if err = iter.Error(); err != nil {
+			return
+		}
+		status.Documents++
+		status.Rows += len(strings.Split(iter.Value(), SEP))
+	}
+
+	db.pendingmu.Lock()
+	status.Pending = db.pending[viewpath.Join()]
+	db.pendingmu.Unlock()
+
+	if lastupdate, err := db.local.Get("viewupdated:" + viewpath.Join()); err == nil {
+		status.LastUpdate, _ = time.Parse(time.RFC3339Nano, lastupdate)
+	}
+
+	if progress, building := db.BuildProgress(viewpath); building {
+		status.Build = &progress
+	}
+
+	viewerrors, err := db.ViewErrors(viewpath)
+	if err != nil {
+		return
+	}
+	status.Errors = len(viewerrors)
+
+	return
+}
+
+// addPending adds n (which may be negative) to the number of documents
+// waiting to be mapped by the view at viewpath.
+func (db *SummaDB) addPending(viewpath types.Path, n int) {
+	db.pendingmu.Lock()
+	defer db.pendingmu.Unlock()
+	db.pending[viewpath.Join()] += n
+	if db.pending[viewpath.Join()] <= 0 {
+		delete(db.pending, viewpath.Join())
+	}
+}
@@ -1,16 +1,40 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
+	"os"
+
 	"github.com/inconshreveable/log15"
 	"github.com/spf13/viper"
 	"github.com/summadb/summadb/database"
 	"github.com/summadb/summadb/server"
+	"github.com/summadb/summadb/types"
 )
 
 var log = log15.New()
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			migrate(os.Args[2:])
+			return
+		case "upgrade":
+			upgrade(os.Args[2:])
+			return
+		case "fsck":
+			fsck(os.Args[2:])
+			return
+		case "stats":
+			stats(os.Args[2:])
+			return
+		}
+	}
+
 	viper.SetDefault("path", "/tmp/summadb-server")
+	viper.SetDefault("backend", "")
+	viper.SetDefault("memory", false)
 	viper.SetDefault("addr", "https://0.0.0.0:6423")
 	viper.SetDefault("crt", "default.crt")
 	viper.SetDefault("key", "default.key")
@@ -27,8 +51,149 @@ func main() {
 		return
 	}
 
-	db := database.Open(viper.GetString("path"))
+	var db *database.SummaDB
+	if viper.GetBool("memory") {
+		db = database.OpenMemory()
+	} else {
+		if backend := viper.GetString("backend"); backend != "" {
+			db, err = database.OpenBackend(backend, viper.GetString("path"))
+		} else {
+			db, err = database.Open(viper.GetString("path"))
+		}
+		if err != nil {
+			if _, ok := err.(database.FormatError); ok {
+				log.Error("opening database, upgrade it with 'summadb upgrade --db <backend>:<path>'",
+					"err", err)
+			} else {
+				log.Error("opening database", "err", err)
+			}
+			return
+		}
+	}
 	defer db.Close()
 
 	server.Start(db, viper.GetString("addr"))
 }
+
+// migrate copies a database from one backend to another, as in
+// "summadb migrate --from goleveldown:/path --to rocksdown:/other".
+func migrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	from := flags.String("from", "", "the database to copy, as <backend>:<path>")
+	to := flags.String("to", "", "where to copy it, as <backend>:<path>, must be empty")
+	flags.Parse(args)
+	if *from == "" || *to == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	report, err := database.Migrate(*from, *to)
+	if err != nil {
+		log.Error("migration failed", "err", err, "backends", database.Backends())
+		os.Exit(1)
+	}
+	log.Info("migration finished",
+		"keys", report.Keys,
+		"checksum", report.Checksum,
+		"localkeys", report.LocalKeys,
+		"localchecksum", report.LocalChecksum)
+}
+
+// upgrade brings a database to the current format, as in
+// "summadb upgrade --db goleveldown:/path".
+func upgrade(args []string) {
+	flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	location := flags.String("db", "", "the database to upgrade, as <backend>:<path>")
+	flags.Parse(args)
+	if *location == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	err := database.Upgrade(*location)
+	if err != nil {
+		log.Error("upgrade failed", "err", err)
+		os.Exit(1)
+	}
+	log.Info("database is up to date")
+}
+
+// fsck looks for inconsistencies in a database and optionally repairs them, as in
+// "summadb fsck --db goleveldown:/path --repair".
+func fsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	location := flags.String("db", "", "the database to check, as <backend>:<path>")
+	path := flags.String("path", "", "check only the tree at this path")
+	repair := flags.Bool("repair", false, "fix the problems found")
+	flags.Parse(args)
+
+	backend, dbpath, err := database.ParseLocation(*location)
+	if err != nil {
+		log.Error("invalid database location", "err", err)
+		flags.Usage()
+		os.Exit(2)
+	}
+	db, err := database.OpenBackend(backend, dbpath)
+	if err != nil {
+		log.Error("opening database", "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	var problems []database.Problem
+	if *repair {
+		problems, err = db.Repair(types.ParsePath(*path))
+	} else {
+		problems, err = db.Check(types.ParsePath(*path))
+	}
+	for _, problem := range problems {
+		log.Warn(problem.Kind,
+			"path", problem.Path,
+			"detail", problem.Detail,
+			"repaired", problem.Repaired)
+	}
+	if err != nil {
+		log.Error("check failed", "err", err)
+		os.Exit(1)
+	}
+	log.Info("check finished", "problems", len(problems), "repaired", *repair)
+	if len(problems) > 0 && !*repair {
+		os.Exit(1)
+	}
+}
+
+// stats prints how much is stored in a tree and its largest children, as in
+// "summadb stats --db goleveldown:/path --path tenants --top 20".
+func stats(args []string) {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	location := flags.String("db", "", "the database, as <backend>:<path>")
+	path := flags.String("path", "", "the tree to measure")
+	top := flags.Int("top", 10, "how many of the largest children to list")
+	flags.Parse(args)
+	if *top < 0 {
+		log.Error("--top can't be negative", "top", *top)
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	backend, dbpath, err := database.ParseLocation(*location)
+	if err != nil {
+		log.Error("invalid database location", "err", err)
+		flags.Usage()
+		os.Exit(2)
+	}
+	db, err := database.OpenBackend(backend, dbpath)
+	if err != nil {
+		log.Error("opening database", "err", err)
+		os.Exit(1)
+	}
+	defer db.Close()
+
+	result, err := db.Stats(types.ParsePath(*path), *top)
+	if err != nil {
+		log.Error("failed to get stats", "err", err)
+		os.Exit(1)
+	}
+	out, _ := json.MarshalIndent(result, "", "  ")
+	os.Stdout.Write(append(out, '\n'))
+}
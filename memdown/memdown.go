@@ -0,0 +1,287 @@
+// Package memdown is a levelup backend that keeps everything in memory,
+// for tests and for databases that don't need to outlive the process.
+package memdown
+
+import (
+	"errors"
+	"hash/fnv"
+	"sync"
+
+	"github.com/fiatjaf/levelup"
+)
+
+// Database keeps its keys in a treap that is never modified: each write
+// copies the nodes on the way to the key it changes and replaces the root,
+// so an iterator only has to hold the root it started from to read
+// a snapshot of the database, without copying anything.
+type Database struct {
+	mu   sync.RWMutex
+	root *node
+}
+
+func NewDatabase() *Database {
+	return &Database{}
+}
+
+func (db *Database) Put(key, value []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.root = db.root.put(string(key), value)
+	return nil
+}
+
+func (db *Database) Get(key []byte) ([]byte, error) {
+	n := db.snapshot().get(string(key))
+	if n == nil {
+		return nil, levelup.NotFound
+	}
+	return append([]byte(nil), n.value...), nil
+}
+
+func (db *Database) Del(key []byte) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.root = db.root.del(string(key))
+	return nil
+}
+
+// Batch applies all operations at once: iterators and readers
+// see either none or all of them.
+func (db *Database) Batch(ops []levelup.Operation) error {
+	for _, op := range ops {
+		if op.Type != "put" && op.Type != "del" {
+			return errors.New("unknown batch operation: " + op.Type)
+		}
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	root := db.root
+	for _, op := range ops {
+		if op.Type == "put" {
+			root = root.put(string(op.Key), op.Value)
+		} else {
+			root = root.del(string(op.Key))
+		}
+	}
+	db.root = root
+	return nil
+}
+
+func (db *Database) snapshot() *node {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.root
+}
+
+// ReadRange iterates from Start (inclusive) to End (exclusive) over
+// a snapshot of the database taken when it is called.
+func (db *Database) ReadRange(opts *levelup.RangeOpts) levelup.ReadIterator {
+	if opts == nil {
+		opts = &levelup.RangeOpts{}
+	}
+
+	iter := &iterator{
+		reverse: opts.Reverse,
+		limit:   opts.Limit,
+	}
+	if opts.Start != nil {
+		iter.start = string(opts.Start)
+		iter.hasStart = true
+	}
+	if opts.End != nil {
+		iter.end = string(opts.End)
+		iter.hasEnd = true
+	}
+	iter.seek(db.snapshot())
+	return iter
+}
+
+// Close drops everything, as there's no way to open the database again.
+func (db *Database) Close() { db.Erase() }
+
+func (db *Database) Erase() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.root = nil
+}
+
+// node is a node of the treap. keys are ordered from left to right and
+// priorities, which come from the keys themselves, from top to bottom.
+// nodes reachable from a root are never modified.
+type node struct {
+	key         string
+	value       []byte
+	priority    uint32
+	left, right *node
+}
+
+func priority(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (n *node) get(key string) *node {
+	for n != nil {
+		switch {
+		case key < n.key:
+			n = n.left
+		case key > n.key:
+			n = n.right
+		default:
+			return n
+		}
+	}
+	return nil
+}
+
+func (n *node) copy() *node {
+	c := *n
+	return &c
+}
+
+// put returns the root of a treap with key set to value. the nodes it
+// returns are new, so they can still be rotated.
+func (n *node) put(key string, value []byte) *node {
+	if n == nil {
+		// values are never modified after stored, so iterators can share them
+		return &node{key: key, value: append([]byte(nil), value...), priority: priority(key)}
+	}
+
+	c := n.copy()
+	switch {
+	case key < n.key:
+		c.left = n.left.put(key, value)
+		if c.left.priority > c.priority {
+			l := c.left
+			c.left, l.right = l.right, c
+			return l
+		}
+	case key > n.key:
+		c.right = n.right.put(key, value)
+		if c.right.priority > c.priority {
+			r := c.right
+			c.right, r.left = r.left, c
+			return r
+		}
+	default:
+		c.value = append([]byte(nil), value...)
+	}
+	return c
+}
+
+// del returns the root of a treap without key.
+func (n *node) del(key string) *node {
+	if n == nil {
+		return nil
+	}
+
+	switch {
+	case key < n.key:
+		left := n.left.del(key)
+		if left == n.left {
+			return n
+		}
+		c := n.copy()
+		c.left = left
+		return c
+	case key > n.key:
+		right := n.right.del(key)
+		if right == n.right {
+			return n
+		}
+		c := n.copy()
+		c.right = right
+		return c
+	default:
+		return join(n.left, n.right)
+	}
+}
+
+// join returns the root of a treap with the nodes of a and b, all the keys
+// of a being smaller than those of b.
+func join(a, b *node) *node {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		c := a.copy()
+		c.right = join(a.right, b)
+		return c
+	}
+	c := b.copy()
+	c.left = join(a, b.left)
+	return c
+}
+
+// iterator walks a treap in order with a stack of the nodes whose keys
+// still have to be read, the next one on top.
+type iterator struct {
+	start, end       string
+	hasStart, hasEnd bool
+	reverse          bool
+	limit            int
+	read             int
+	stack            []*node
+}
+
+// seek stacks the way from root to the first key in the range.
+func (iter *iterator) seek(root *node) {
+	for n := root; n != nil; {
+		if iter.reverse {
+			if iter.hasEnd && n.key >= iter.end {
+				n = n.left
+			} else {
+				iter.stack = append(iter.stack, n)
+				n = n.right
+			}
+		} else {
+			if iter.hasStart && n.key < iter.start {
+				n = n.right
+			} else {
+				iter.stack = append(iter.stack, n)
+				n = n.left
+			}
+		}
+	}
+}
+
+func (iter *iterator) Next() {
+	n := iter.stack[len(iter.stack)-1]
+	iter.stack = iter.stack[:len(iter.stack)-1]
+	iter.read++
+
+	// the keys after n are the ones in the subtree on its other side,
+	// then the ones already stacked
+	if iter.reverse {
+		for n = n.left; n != nil; n = n.right {
+			iter.stack = append(iter.stack, n)
+		}
+	} else {
+		for n = n.right; n != nil; n = n.left {
+			iter.stack = append(iter.stack, n)
+		}
+	}
+}
+
+func (iter *iterator) Valid() bool {
+	if len(iter.stack) == 0 || (iter.limit > 0 && iter.read >= iter.limit) {
+		return false
+	}
+	key := iter.stack[len(iter.stack)-1].key
+	if iter.reverse {
+		return !iter.hasStart || key >= iter.start
+	}
+	return !iter.hasEnd || key < iter.end
+}
+
+func (iter *iterator) Error() error { return nil }
+func (iter *iterator) Key() []byte  { return []byte(iter.stack[len(iter.stack)-1].key) }
+func (iter *iterator) Value() []byte {
+	return append([]byte(nil), iter.stack[len(iter.stack)-1].value...)
+}
+func (iter *iterator) Release() { iter.stack = nil }
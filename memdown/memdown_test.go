@@ -0,0 +1,156 @@
+package memdown
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/fiatjaf/levelup"
+	. "gopkg.in/check.v1"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type MemdownSuite struct{}
+
+var _ = Suite(&MemdownSuite{})
+
+func keys(iter levelup.ReadIterator) (keys []string) {
+	defer iter.Release()
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return
+}
+
+func (s *MemdownSuite) TestBasics(c *C) {
+	db := NewDatabase()
+
+	c.Assert(db.Put([]byte("a"), []byte("1")), IsNil)
+	value, err := db.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "1")
+
+	// values are copied
+	value[0] = '9'
+	value, _ = db.Get([]byte("a"))
+	c.Assert(string(value), Equals, "1")
+
+	c.Assert(db.Del([]byte("a")), IsNil)
+	c.Assert(db.Del([]byte("a")), IsNil)
+	_, err = db.Get([]byte("a"))
+	c.Assert(err, Equals, levelup.NotFound)
+
+	db.Put([]byte("b"), []byte("2"))
+	db.Erase()
+	_, err = db.Get([]byte("b"))
+	c.Assert(err, Equals, levelup.NotFound)
+	c.Assert(keys(db.ReadRange(nil)), HasLen, 0)
+}
+
+func (s *MemdownSuite) TestRanges(c *C) {
+	db := NewDatabase()
+	for _, key := range []string{"c", "a", "b\x00", "b", "d", "\xff"} {
+		db.Put([]byte(key), []byte(key))
+	}
+
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{})), DeepEquals,
+		[]string{"a", "b", "b\x00", "c", "d", "\xff"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("b"), End: []byte("d")})), DeepEquals,
+		[]string{"b", "b\x00", "c"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("b"), End: []byte("d"), Reverse: true})), DeepEquals,
+		[]string{"c", "b\x00", "b"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("bb"), Limit: 2})), DeepEquals,
+		[]string{"c", "d"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{End: []byte("c"), Reverse: true, Limit: 1})), DeepEquals,
+		[]string{"b\x00"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("x"), End: []byte("b")})), HasLen, 0)
+
+	// iterators don't see what is written after they were created
+	iter := db.ReadRange(&levelup.RangeOpts{})
+	db.Put([]byte("aa"), nil)
+	db.Del([]byte("c"))
+	c.Assert(keys(iter), DeepEquals, []string{"a", "b", "b\x00", "c", "d", "\xff"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{})), DeepEquals,
+		[]string{"a", "aa", "b", "b\x00", "d", "\xff"})
+}
+
+func (s *MemdownSuite) TestBatch(c *C) {
+	db := NewDatabase()
+	db.Put([]byte("x"), []byte("1"))
+
+	c.Assert(db.Batch([]levelup.Operation{
+		levelup.Put([]byte("y"), []byte("2")),
+		levelup.Del([]byte("x")),
+		levelup.Put([]byte("z"), []byte("3")),
+		levelup.Put([]byte("y"), []byte("4")),
+	}), IsNil)
+	c.Assert(keys(db.ReadRange(nil)), DeepEquals, []string{"y", "z"})
+	value, _ := db.Get([]byte("y"))
+	c.Assert(string(value), Equals, "4")
+
+	// nothing is applied if an operation is invalid
+	c.Assert(db.Batch([]levelup.Operation{
+		levelup.Del([]byte("y")),
+		{Type: "merge", Key: []byte("z")},
+	}), Not(IsNil))
+	c.Assert(keys(db.ReadRange(nil)), DeepEquals, []string{"y", "z"})
+
+	// batches are atomic to concurrent readers
+	db.Put([]byte("z"), []byte("4"))
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			db.Batch([]levelup.Operation{
+				levelup.Put([]byte("y"), []byte(strconv.Itoa(i))),
+				levelup.Put([]byte("z"), []byte(strconv.Itoa(i))),
+			})
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		iter := db.ReadRange(nil)
+		y := string(iter.Value())
+		iter.Next()
+		c.Assert(string(iter.Value()), Equals, y)
+		iter.Release()
+	}
+	wg.Wait()
+}
+
+func (s *MemdownSuite) TestManyKeys(c *C) {
+	db := NewDatabase()
+	expected := make(map[string]bool)
+	for i := 0; i < 2000; i++ {
+		key := strconv.Itoa(i * 7919 % 2000)
+		db.Put([]byte(key), []byte(key))
+		expected[key] = true
+	}
+	iter := db.ReadRange(nil)
+	for i := 0; i < 2000; i += 3 {
+		key := strconv.Itoa(i)
+		db.Del([]byte(key))
+		delete(expected, key)
+	}
+
+	// the iterator still sees all of them, in order
+	all := keys(iter)
+	c.Assert(all, HasLen, 2000)
+	c.Assert(sort.StringsAreSorted(all), Equals, true)
+
+	remaining := keys(db.ReadRange(nil))
+	c.Assert(remaining, HasLen, len(expected))
+	c.Assert(sort.StringsAreSorted(remaining), Equals, true)
+	for _, key := range remaining {
+		c.Assert(expected[key], Equals, true)
+	}
+	reversed := keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("1"), End: []byte("2"), Reverse: true}))
+	c.Assert(sort.IsSorted(sort.Reverse(sort.StringSlice(reversed))), Equals, true)
+	for _, key := range reversed {
+		c.Assert(key >= "1" && key < "2", Equals, true)
+	}
+}
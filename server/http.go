@@ -1,11 +1,111 @@
 package server
 
 import (
+	"encoding/json"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/summadb/summadb/database"
+	"github.com/summadb/summadb/types"
 )
 
 func handlehttp(db *database.SummaDB, w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("hello"))
+	switch {
+	case r.URL.Path == "/_views" || strings.HasPrefix(r.URL.Path, "/_views/"):
+		handleviews(db, w, r)
+	case r.URL.Path == "/_stats" || strings.HasPrefix(r.URL.Path, "/_stats/"):
+		handlestats(db, w, r)
+	default:
+		w.Write([]byte("hello"))
+	}
+}
+
+// urlPath reads the path after prefix in the url. each url segment, once
+// decoded, is an escaped path segment, so "a%252Fb" is the key "a/b".
+func urlPath(r *http.Request, prefix string) types.Path {
+	var p types.Path
+	for _, segment := range strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), prefix), "/") {
+		if decoded, err := url.PathUnescape(segment); err == nil {
+			segment = decoded
+		}
+		p = append(p, types.ParsePath(segment)...)
+	}
+	return p
+}
+
+// handleviews answers with the status of all views at /_views
+// or of a single view at /_views/<path>.
+func handleviews(db *database.SummaDB, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	var result interface{}
+	if p := urlPath(r, "/_views"); len(p) > 0 {
+		status, err := db.ViewStatus(p)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+		result = status
+	} else {
+		paths, err := db.ListViews()
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write(jsonError(err.Error()))
+			return
+		}
+		statuses := make([]database.ViewStatus, 0, len(paths))
+		for _, p := range paths {
+			status, err := db.ViewStatus(p)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write(jsonError(err.Error()))
+				return
+			}
+			statuses = append(statuses, status)
+		}
+		result = statuses
+	}
+
+	resp, err := json.Marshal(result)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write(jsonError(err.Error()))
+		return
+	}
+	w.Write(resp)
+}
+
+// handlestats answers with the storage stats of the tree at /_stats/<path>,
+// listing as many of its largest children as given in ?top= (10 by default).
+func handlestats(db *database.SummaDB, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	top := 10
+	if value := r.URL.Query().Get("top"); value != "" {
+		var err error
+		if top, err = strconv.Atoi(value); err != nil || top < 0 {
+			w.WriteHeader(400)
+			w.Write(jsonError("invalid top: " + value))
+			return
+		}
+	}
+
+	p := urlPath(r, "/_stats")
+	stats, err := db.Stats(p, top)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write(jsonError(err.Error()))
+		return
+	}
+
+	resp, err := json.Marshal(stats)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write(jsonError(err.Error()))
+		return
+	}
+	w.Write(resp)
 }
@@ -70,10 +70,11 @@ func handlewebsocket(db *database.SummaDB, w http.ResponseWriter, r *http.Reques
 			answer(resp)
 		case "records":
 			records, err := db.Query(args.Path, database.QueryParams{
-				KeyStart:   args.KeyStart,
-				KeyEnd:     args.KeyEnd,
-				Descending: args.Descending,
-				Limit:      args.Limit,
+				KeyStart:    args.KeyStart,
+				KeyEnd:      args.KeyEnd,
+				Descending:  args.Descending,
+				Limit:       args.limit(0),
+				IncludeDocs: args.IncludeDocs,
 			})
 			if err != nil {
 				answer(jsonError(err.Error()))
@@ -85,6 +86,72 @@ func handlewebsocket(db *database.SummaDB, w http.ResponseWriter, r *http.Reques
 				continue
 			}
 			answer(resp)
+		case "view_errors":
+			viewerrors, err := db.ViewErrors(args.Path)
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			resp, err := json.Marshal(viewerrors)
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			answer(resp)
+		case "list_views":
+			paths, err := db.ListViews()
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			resp, err := json.Marshal(paths)
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			answer(resp)
+		case "view_status":
+			status, err := db.ViewStatus(args.Path)
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			resp, err := json.Marshal(status)
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			answer(resp)
+		case "stats":
+			stats, err := db.Stats(args.Path, args.limit(10))
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			resp, err := json.Marshal(stats)
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			answer(resp)
+		case "test_view":
+			result, err := db.TestView(database.TestViewParams{
+				Map:    args.Map,
+				Reduce: args.Reduce,
+				Docs:   args.Docs.Branches,
+				Path:   args.Path,
+				Limit:  args.limit(0),
+			})
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			resp, err := json.Marshal(result)
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			answer(resp)
 		case "set":
 			err := db.Set(args.Path, args.Record)
 			if err != nil {
@@ -106,6 +173,13 @@ func handlewebsocket(db *database.SummaDB, w http.ResponseWriter, r *http.Reques
 				continue
 			}
 			answer(jsonSuccess())
+		case "move":
+			err := db.Move(args.Path, args.To, args.Rev)
+			if err != nil {
+				answer(jsonError(err.Error()))
+				continue
+			}
+			answer(jsonSuccess())
 		case "replicate":
 			// enter replication state. lock everything until the replication completes.
 			replicationId := string(messageId)
@@ -123,12 +197,26 @@ func handlewebsocket(db *database.SummaDB, w http.ResponseWriter, r *http.Reques
 
 type Arguments struct {
 	Path       types.Path `json:"path"`
+	To         types.Path `json:"to"`
 	Record     types.Tree `json:"record"`
 	Rev        string     `json:"rev"`
 	KeyStart   string     `json:"key_start"`
 	KeyEnd     string     `json:"key_end"`
 	Descending bool       `json:"descending"`
-	Limit      int        `json:limit`
+	Limit      *int       `json:"limit"`
+	Map        string     `json:"map"`
+	Reduce     string     `json:"reduce"`
+	Docs       types.Tree `json:"docs"`
+
+	IncludeDocs bool `json:"include_docs"`
+}
+
+// limit returns the limit given in the message, or def if there's none.
+func (args Arguments) limit(def int) int {
+	if args.Limit == nil {
+		return def
+	}
+	return *args.Limit
 }
 
 func send(c *websocket.Conn, args ...[]byte) {
@@ -24,7 +24,7 @@ var _ = Suite(&ServerSuite{})
 
 func (s *ServerSuite) TestWebSocket(c *C) {
 	var err error
-	db := database.Open("/tmp/summadb-test-websocket")
+	db := database.OpenMemory()
 	defer db.Erase()
 	h := &Handler{db}
 	srv := httptest.NewServer(h)
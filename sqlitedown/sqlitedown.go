@@ -0,0 +1,189 @@
+// Package sqlitedown is a levelup backend that stores everything in a single
+// SQLite file, using a driver written in pure Go.
+package sqlitedown
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/fiatjaf/levelup"
+	_ "modernc.org/sqlite"
+)
+
+type Database struct {
+	path string
+	db   *sql.DB
+}
+
+// NewDatabase opens the SQLite file at path, creating it if it doesn't exist.
+// it panics if the file can't be opened, like the other backends.
+func NewDatabase(path string) *Database {
+	// readers see a snapshot and don't block writers in WAL mode,
+	// and writers wait for each other instead of failing.
+	db, err := sql.Open("sqlite", "file:"+path+
+		"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(10000)&_pragma=synchronous(NORMAL)")
+	if err != nil {
+		panic(err)
+	}
+
+	// keys are blobs, so they are compared byte by byte, as in leveldb.
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (
+        k BLOB PRIMARY KEY,
+        v BLOB NOT NULL
+    ) WITHOUT ROWID`)
+	if err != nil {
+		db.Close()
+		panic(err)
+	}
+
+	return &Database{path, db}
+}
+
+func (d *Database) Put(key, value []byte) error {
+	return put(d.db, key, value)
+}
+
+func (d *Database) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := d.db.QueryRow(`SELECT v FROM kv WHERE k = ?`, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, levelup.NotFound
+	}
+	return value, err
+}
+
+func (d *Database) Del(key []byte) error {
+	return del(d.db, key)
+}
+
+// Batch applies all operations in a single transaction.
+func (d *Database) Batch(ops []levelup.Operation) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case "put":
+			err = put(tx, op.Key, op.Value)
+		case "del":
+			err = del(tx, op.Key)
+		default:
+			err = errors.New("unknown batch operation: " + op.Type)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+type execer interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+}
+
+func put(e execer, key, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	_, err := e.Exec(`INSERT INTO kv (k, v) VALUES (?, ?)
+        ON CONFLICT (k) DO UPDATE SET v = excluded.v`, key, value)
+	return err
+}
+
+func del(e execer, key []byte) error {
+	_, err := e.Exec(`DELETE FROM kv WHERE k = ?`, key)
+	return err
+}
+
+// ReadRange iterates from Start (inclusive) to End (exclusive). the rows
+// are read as the iterator advances, from a snapshot taken when it starts.
+func (d *Database) ReadRange(opts *levelup.RangeOpts) levelup.ReadIterator {
+	if opts == nil {
+		opts = &levelup.RangeOpts{}
+	}
+
+	var where []string
+	var args []interface{}
+	if opts.Start != nil {
+		where = append(where, "k >= ?")
+		args = append(args, opts.Start)
+	}
+	if opts.End != nil {
+		where = append(where, "k < ?")
+		args = append(args, opts.End)
+	}
+
+	query := "SELECT k, v FROM kv"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY k"
+	if opts.Reverse {
+		query += " DESC"
+	}
+	if opts.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	iter := &iterator{}
+	iter.rows, iter.err = d.db.Query(query, args...)
+	if iter.err == nil {
+		iter.Next()
+	}
+	return iter
+}
+
+func (d *Database) Close() {
+	d.db.Close()
+}
+
+// Erase closes the database and deletes its file.
+func (d *Database) Erase() {
+	d.db.Close()
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(d.path + suffix)
+	}
+}
+
+type iterator struct {
+	rows  *sql.Rows
+	valid bool
+	key   []byte
+	value []byte
+	err   error
+}
+
+func (iter *iterator) Next() {
+	iter.valid = false
+	if iter.err != nil {
+		return
+	}
+	if !iter.rows.Next() {
+		iter.err = iter.rows.Err()
+		iter.rows.Close()
+		return
+	}
+	iter.key, iter.value = nil, nil
+	if iter.err = iter.rows.Scan(&iter.key, &iter.value); iter.err != nil {
+		iter.rows.Close()
+		return
+	}
+	iter.valid = true
+}
+
+func (iter *iterator) Valid() bool   { return iter.valid }
+func (iter *iterator) Error() error  { return iter.err }
+func (iter *iterator) Key() []byte   { return iter.key }
+func (iter *iterator) Value() []byte { return iter.value }
+
+func (iter *iterator) Release() {
+	iter.valid = false
+	if iter.rows != nil {
+		iter.rows.Close()
+	}
+}
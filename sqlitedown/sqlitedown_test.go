@@ -0,0 +1,132 @@
+package sqlitedown
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/fiatjaf/levelup"
+	. "gopkg.in/check.v1"
+)
+
+func TestAll(t *testing.T) {
+	TestingT(t)
+}
+
+type SqlitedownSuite struct{}
+
+var _ = Suite(&SqlitedownSuite{})
+
+func keys(iter levelup.ReadIterator) (keys []string) {
+	defer iter.Release()
+	for ; iter.Valid(); iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	return
+}
+
+func (s *SqlitedownSuite) TestBasics(c *C) {
+	db := NewDatabase("/tmp/summadb-test-sqlitedown-basics")
+	defer db.Erase()
+
+	c.Assert(db.Put([]byte("a"), []byte("1")), IsNil)
+	c.Assert(db.Put([]byte("a"), []byte("2")), IsNil)
+	value, err := db.Get([]byte("a"))
+	c.Assert(err, IsNil)
+	c.Assert(string(value), Equals, "2")
+
+	c.Assert(db.Del([]byte("a")), IsNil)
+	c.Assert(db.Del([]byte("a")), IsNil)
+	_, err = db.Get([]byte("a"))
+	c.Assert(err, Equals, levelup.NotFound)
+
+	// it is all in a file
+	db.Put([]byte("b"), []byte{})
+	db.Close()
+	db = NewDatabase("/tmp/summadb-test-sqlitedown-basics")
+	value, err = db.Get([]byte("b"))
+	c.Assert(err, IsNil)
+	c.Assert(value, HasLen, 0)
+
+	db.Erase()
+	_, err = os.Stat("/tmp/summadb-test-sqlitedown-basics")
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *SqlitedownSuite) TestRanges(c *C) {
+	db := NewDatabase("/tmp/summadb-test-sqlitedown-ranges")
+	defer db.Erase()
+	for _, key := range []string{"c", "a", "b\x00", "b", "d", "\xff"} {
+		db.Put([]byte(key), []byte(key))
+	}
+
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{})), DeepEquals,
+		[]string{"a", "b", "b\x00", "c", "d", "\xff"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("b"), End: []byte("d")})), DeepEquals,
+		[]string{"b", "b\x00", "c"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("b"), End: []byte("d"), Reverse: true})), DeepEquals,
+		[]string{"c", "b\x00", "b"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("bb"), Limit: 2})), DeepEquals,
+		[]string{"c", "d"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{End: []byte("c"), Reverse: true, Limit: 1})), DeepEquals,
+		[]string{"b\x00"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{Start: []byte("x"), End: []byte("b")})), HasLen, 0)
+
+	iter := db.ReadRange(nil)
+	c.Assert(string(iter.Value()), Equals, "a")
+	iter.Release()
+	c.Assert(iter.Valid(), Equals, false)
+	c.Assert(iter.Error(), IsNil)
+
+	// iterators don't see what is written after they were created
+	iter = db.ReadRange(&levelup.RangeOpts{})
+	c.Assert(db.Put([]byte("aa"), nil), IsNil)
+	c.Assert(db.Del([]byte("c")), IsNil)
+	c.Assert(keys(iter), DeepEquals, []string{"a", "b", "b\x00", "c", "d", "\xff"})
+	c.Assert(keys(db.ReadRange(&levelup.RangeOpts{})), DeepEquals,
+		[]string{"a", "aa", "b", "b\x00", "d", "\xff"})
+}
+
+func (s *SqlitedownSuite) TestBatch(c *C) {
+	db := NewDatabase("/tmp/summadb-test-sqlitedown-batch")
+	defer db.Erase()
+	db.Put([]byte("x"), []byte("1"))
+
+	c.Assert(db.Batch([]levelup.Operation{
+		levelup.Put([]byte("y"), []byte("2")),
+		levelup.Del([]byte("x")),
+		levelup.Put([]byte("z"), []byte("2")),
+	}), IsNil)
+	c.Assert(keys(db.ReadRange(nil)), DeepEquals, []string{"y", "z"})
+
+	// nothing is applied if an operation is invalid
+	c.Assert(db.Batch([]levelup.Operation{
+		levelup.Del([]byte("y")),
+		{Type: "merge", Key: []byte("z")},
+	}), Not(IsNil))
+	c.Assert(keys(db.ReadRange(nil)), DeepEquals, []string{"y", "z"})
+
+	// batches are atomic to concurrent readers and writers
+	var wg sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 30; i++ {
+				c.Check(db.Batch([]levelup.Operation{
+					levelup.Put([]byte("y"), []byte(strconv.Itoa(i))),
+					levelup.Put([]byte("z"), []byte(strconv.Itoa(i))),
+				}), IsNil)
+			}
+		}()
+	}
+	for i := 0; i < 30; i++ {
+		iter := db.ReadRange(nil)
+		y := string(iter.Value())
+		iter.Next()
+		c.Assert(string(iter.Value()), Equals, y)
+		iter.Release()
+	}
+	wg.Wait()
+}
@@ -1,43 +1,103 @@
 package types
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"math"
+	"math/big"
+	"regexp"
 	"strconv"
 
-	"github.com/a8m/djson"
 	"github.com/summadb/summadb/utils"
 )
 
 const (
 	STRING    = 's'
 	NUMBER    = 'n'
+	INTEGER   = 'i'
+	DECIMAL   = 'd'
 	BOOL      = 'b'
 	NULL      = 'u'
 	UNDEFINED = 0
 )
 
+// integers up to this are represented exactly by float64.
+const maxSafeInteger = 1 << 53
+
 type Leaf struct {
 	Kind byte
 	float64
-	string
+	int64
+	string // also the digits of DECIMAL leaves
 	bool
 }
 
-func BoolLeaf(v bool) Leaf      { return Leaf{Kind: BOOL, bool: v} }
-func StringLeaf(v string) Leaf  { return Leaf{Kind: STRING, string: v} }
+func BoolLeaf(v bool) Leaf     { return Leaf{Kind: BOOL, bool: v} }
+func StringLeaf(v string) Leaf { return Leaf{Kind: STRING, string: v} }
+func IntegerLeaf(v int64) Leaf { return Leaf{Kind: INTEGER, int64: v} }
+func NullLeaf() Leaf           { return Leaf{Kind: NULL} }
+
+// NumberLeaf makes a float leaf, even if v is integral. only numbers
+// written without a fraction or an exponent become INTEGER leaves.
 func NumberLeaf(v float64) Leaf { return Leaf{Kind: NUMBER, float64: v} }
-func NullLeaf() Leaf            { return Leaf{Kind: NULL} }
 
-func (l Leaf) String() string  { return l.string }
-func (l Leaf) Number() float64 { return l.float64 }
-func (l Leaf) Bool() bool      { return l.bool }
+// decimalNumber is the syntax of numbers in JSON.
+var decimalNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// DecimalLeaf makes an arbitrary precision number leaf from its decimal
+// notation, like "1234567890123456789.99". it returns a null leaf if v
+// is not a number as JSON writes them.
+func DecimalLeaf(v string) Leaf {
+	if !decimalNumber.MatchString(v) {
+		return NullLeaf()
+	}
+	return Leaf{Kind: DECIMAL, string: v}
+}
+
+func (l Leaf) String() string { return l.string }
+func (l Leaf) Int() int64     { return l.int64 }
+func (l Leaf) Bool() bool     { return l.bool }
+
+// Number returns the value of any numeric leaf as a float64,
+// which may not be exact for INTEGER and DECIMAL leaves.
+func (l Leaf) Number() float64 {
+	switch l.Kind {
+	case INTEGER:
+		return float64(l.int64)
+	case DECIMAL:
+		f, _ := strconv.ParseFloat(l.string, 64)
+		return f
+	}
+	return l.float64
+}
+
+// Exact tells if Number() returns the exact value of the leaf.
+func (l Leaf) Exact() bool {
+	switch l.Kind {
+	case INTEGER:
+		return l.int64 >= -maxSafeInteger && l.int64 <= maxSafeInteger
+	case DECIMAL:
+		return false
+	}
+	return true
+}
 
 func (l Leaf) MarshalJSON() ([]byte, error) {
 	switch l.Kind {
 	case STRING:
 		return utils.JSONString(l.string), nil
 	case NUMBER:
-		return []byte(strconv.FormatFloat(l.float64, 'f', -1, 32)), nil
+		// integral floats get a fraction, so they are read back as floats
+		formatted := strconv.FormatFloat(l.float64, 'f', -1, 64)
+		if l.float64 == math.Trunc(l.float64) && !math.IsInf(l.float64, 0) {
+			formatted += ".0"
+		}
+		return []byte(formatted), nil
+	case INTEGER:
+		return []byte(strconv.FormatInt(l.int64, 10)), nil
+	case DECIMAL:
+		return []byte(l.string), nil
 	case BOOL:
 		if l.bool {
 			return []byte("true"), nil
@@ -50,7 +110,7 @@ func (l Leaf) MarshalJSON() ([]byte, error) {
 }
 
 func (l *Leaf) UnmarshalJSON(j []byte) error {
-	v, err := djson.Decode(j)
+	v, err := decodeJSON(j)
 	if err != nil {
 		return err
 	}
@@ -59,12 +119,24 @@ func (l *Leaf) UnmarshalJSON(j []byte) error {
 	return nil
 }
 
+// decodeJSON decodes numbers as json.Number, so they don't lose precision.
+func decodeJSON(j []byte) (v interface{}, err error) {
+	decoder := json.NewDecoder(bytes.NewReader(j))
+	decoder.UseNumber()
+	err = decoder.Decode(&v)
+	return
+}
+
 func LeafFromInterface(v interface{}) Leaf {
 	switch val := v.(type) {
 	case int:
-		return NumberLeaf(float64(val))
+		return IntegerLeaf(int64(val))
+	case int64:
+		return IntegerLeaf(val)
 	case float64:
 		return NumberLeaf(val)
+	case json.Number:
+		return numberLeaf(string(val))
 	case string:
 		return StringLeaf(val)
 	case bool:
@@ -74,10 +146,32 @@ func LeafFromInterface(v interface{}) Leaf {
 	}
 }
 
+// numberLeaf makes the leaf for a number in decimal notation: an INTEGER
+// if it fits in int64, a NUMBER if float64 keeps all its digits
+// and a DECIMAL otherwise, even if its exponent is too large to compute.
+func numberLeaf(v string) Leaf {
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return IntegerLeaf(i)
+	}
+
+	if f, err := strconv.ParseFloat(v, 64); err == nil {
+		exact, ok := new(big.Rat).SetString(v)
+		shortest, _ := new(big.Rat).SetString(strconv.FormatFloat(f, 'g', -1, 64))
+		if ok && shortest.Cmp(exact) == 0 {
+			return NumberLeaf(f)
+		}
+	}
+	return DecimalLeaf(v)
+}
+
 func (l Leaf) ToInterface() interface{} {
 	switch l.Kind {
 	case NUMBER:
 		return l.float64
+	case INTEGER:
+		return l.int64
+	case DECIMAL:
+		return json.Number(l.string)
 	case STRING:
 		return l.string
 	case BOOL:
@@ -1,12 +1,23 @@
 package types
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
+// Path is a list of segments. a segment is either a special key, starting
+// with "_" or "!", or an escaped key (see EscapeKey).
 type Path []string
 
+// ParsePath splits s on "/". the segments are taken as they are, already
+// escaped, so "a b/c%2Fd" has the keys "a b" and "c/d". to make a path from
+// raw keys use PathFromKeys.
 func ParsePath(s string) Path {
 	splt := strings.Split(s, "/")
 	var path Path
@@ -19,8 +30,107 @@ func ParsePath(s string) Path {
 	return path
 }
 
+// PathFromKeys makes a path from unescaped keys.
+func PathFromKeys(keys ...string) Path {
+	path := make(Path, len(keys))
+	for i, key := range keys {
+		path[i] = EscapeKey(key)
+	}
+	return path
+}
+
+// Keys returns the unescaped keys of the path.
+func (p Path) Keys() []string {
+	keys := make([]string, len(p))
+	for i, segment := range p {
+		keys[i] = UnescapeKey(segment)
+	}
+	return keys
+}
+
 func (p Path) Join() string { return strings.Join(p, "/") }
 
+// UnmarshalJSON takes either a string, parsed with ParsePath, or an array
+// of raw keys, escaped like in PathFromKeys. special keys can't be in the
+// array, as their escaped forms are ordinary keys.
+func (p *Path) UnmarshalJSON(j []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(j, &v); err != nil {
+		return err
+	}
+
+	switch val := v.(type) {
+	case string:
+		*p = ParsePath(val)
+	case []interface{}:
+		path := make(Path, 0, len(val))
+		for _, segment := range val {
+			s, ok := segment.(string)
+			if !ok {
+				return errors.New("path keys must be strings")
+			}
+			if s != "" && (s[0] == '_' || s[0] == '!') {
+				return errors.New("special keys can't be path segments: " + s)
+			}
+			path = append(path, EscapeKey(s))
+		}
+		*p = path
+	case nil:
+		*p = nil
+	default:
+		return errors.New("path must be a string or an array of segments")
+	}
+	return nil
+}
+
+// EscapeKey turns any string into a segment that can be used in a path:
+// "%", "/", a leading "_" or "!" and leading or trailing whitespace are
+// percent-encoded. the empty key is "%".
+func EscapeKey(key string) string {
+	if key == "" {
+		return "%"
+	}
+
+	start := len(key) - len(strings.TrimLeftFunc(key, unicode.IsSpace))
+	end := len(strings.TrimRightFunc(key, unicode.IsSpace))
+
+	var buf bytes.Buffer
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c == '%' || c == '/' || i < start || i >= end ||
+			(i == 0 && (c == '_' || c == '!')) {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
+
+// UnescapeKey is the reverse of EscapeKey. percent signs not followed
+// by two hex digits are kept as they are.
+func UnescapeKey(segment string) string {
+	if segment == "%" {
+		return ""
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(segment); i++ {
+		if segment[i] == '%' && i+2 < len(segment) && isHex(segment[i+1]) && isHex(segment[i+2]) {
+			b, _ := strconv.ParseUint(segment[i+1:i+3], 16, 8)
+			buf.WriteByte(byte(b))
+			i += 2
+			continue
+		}
+		buf.WriteByte(segment[i])
+	}
+	return buf.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
 func (target Path) RelativeTo(source Path) Path {
 	length := int(math.Min(float64(len(target)), float64(len(source))))
 	samepartslength := length
@@ -74,6 +184,7 @@ func (p Path) ReadValid() bool {
 }
 
 func (p Path) WriteValid() bool {
+	inview := false
 	for i, key := range p {
 		if key == "" {
 			return false
@@ -81,13 +192,49 @@ func (p Path) WriteValid() bool {
 		if key[0] == '_' {
 			return false
 		}
-		if key[0] == '!' && i != len(p)-1 {
+		if key[0] != '!' {
+			if inview && p[i-1] != "!map" {
+				// other views can only be defined on the rows right under
+				// a "!map": <view>/!map/<key>
+				return false
+			}
+			continue
+		}
+
+		last := i == len(p)-1
+		switch {
+		case key == "!map" && !last:
+			// the rows of a view, on which other views can be defined.
+			if next := p[i+1]; next == "" || next[0] == '_' || next[0] == '!' {
+				return false
+			}
+			inview = true
+		case last && inview:
+			// and the only special keys inside them are their functions:
+			// <view>/!map/<key>/!map or !reduce
+			if key != "!map" && key != "!reduce" {
+				return false
+			}
+		case last:
+		case key == "!lib" && i == len(p)-2 && !inview:
+			// libraries are the only other special keys with children: !lib/<name>
+		default:
 			return false
 		}
 	}
 	return true
 }
 
+// InsideView tells if the path points to the rows emitted by a map function.
+func (p Path) InsideView() bool {
+	for i, key := range p {
+		if key == "!map" && i != len(p)-1 {
+			return true
+		}
+	}
+	return false
+}
+
 func (p Path) IsLeaf() bool {
 	last := p.Last()
 	if len(last) > 0 && last[0] != '_' && last[0] != '!' {
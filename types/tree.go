@@ -2,20 +2,26 @@ package types
 
 import (
 	"bytes"
+	"sort"
+	"strconv"
 	"strings"
 
-	"github.com/a8m/djson"
 	"github.com/summadb/summadb/utils"
 )
 
 type Tree struct {
 	Leaf
 	Branches
-	Rev     string
-	Map     string
-	Reduce  string
-	Deleted bool
-	Key     string
+	Rev      string
+	Map      string
+	MapDepth int // the level of the nodes the map function is run on, 1 (the children) if 0
+	Reduce   string
+	Deleted  bool
+	Key      string
+	Array    bool // the branches are the elements of an array, keyed by their index
+
+	// the document that emitted this row, when querying views with IncludeDocs
+	Doc *Tree
 
 	// fields for requesting values on Select()
 	RequestLeaf    bool
@@ -31,7 +37,7 @@ type Branches map[string]*Tree
 func NewTree() *Tree { return &Tree{Branches: make(Branches)} }
 
 func (t *Tree) UnmarshalJSON(j []byte) error {
-	v, err := djson.Decode(j)
+	v, err := decodeJSON(j)
 	if err != nil {
 		return err
 	}
@@ -50,6 +56,13 @@ func TreeFromInterface(v interface{}) Tree {
 			newmap[keyname.(string)] = value
 		}
 		return TreeFromInterface(newmap)
+	case []interface{}:
+		t.Array = true
+		t.Branches = make(Branches, len(val))
+		for i, v := range val {
+			subt := TreeFromInterface(v)
+			t.Branches[strconv.Itoa(i)] = &subt
+		}
 	case map[string]interface{}:
 		if key, ok := val["_key"]; ok {
 			t.Key = key.(string)
@@ -63,23 +76,38 @@ func TreeFromInterface(v interface{}) Tree {
 		if mapf, ok := val["!map"]; ok {
 			t.Map = mapf.(string)
 		}
+		if mapdepth, ok := val["!mapdepth"]; ok {
+			if depth := LeafFromInterface(mapdepth); depth.Kind == INTEGER {
+				t.MapDepth = int(depth.Int())
+			}
+		}
 		if reducef, ok := val["!reduce"]; ok {
 			t.Reduce = reducef.(string)
 		}
 		if deleted, ok := val["_del"]; ok {
 			t.Deleted = deleted.(bool)
 		}
+		if doc, ok := val["_doc"]; ok {
+			doctree := TreeFromInterface(doc)
+			t.Doc = &doctree
+		}
+		if array, ok := val["_arr"]; ok {
+			t.Array, _ = array.(bool)
+		}
 
 		delete(val, "_key")
 		delete(val, "_val")
 		delete(val, "_rev")
 		delete(val, "!map")
+		delete(val, "!mapdepth")
 		delete(val, "!reduce")
 		delete(val, "_del")
+		delete(val, "_doc")
+		delete(val, "_arr")
 		t.Branches = make(Branches, len(val))
 		for k, v := range val {
 			subt := TreeFromInterface(v)
-			t.Branches[k] = &subt
+			t.Branches[branchKey(k)] = &subt
 		}
 	default:
 		t.Leaf = LeafFromInterface(v)
@@ -87,7 +115,82 @@ func TreeFromInterface(v interface{}) Tree {
 	return t
 }
 
+// branchKey escapes a raw key from JSON. libraries are the only special
+// key that can come as a branch.
+func branchKey(k string) string {
+	if k == "!lib" {
+		return k
+	}
+	return EscapeKey(k)
+}
+
+// jsonKey is the reverse of branchKey.
+func jsonKey(k string) string {
+	if k != "" && (k[0] == '_' || k[0] == '!') {
+		return k
+	}
+	return UnescapeKey(k)
+}
+
+// Elements returns the branches of an array ordered by their index,
+// leaving out the ones whose keys aren't indexes.
+func (t Tree) Elements() []*Tree {
+	indexes := make([]int, 0, len(t.Branches))
+	for k, branch := range t.Branches {
+		if i, ok := ArrayIndex(k); ok && !branch.Deleted {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	elements := make([]*Tree, len(indexes))
+	for i, index := range indexes {
+		elements[i] = t.Branches[strconv.Itoa(index)]
+	}
+	return elements
+}
+
+// ArrayIndex tells if key is the index of an element of an array, written
+// the only way strconv.Itoa writes it, so "01" or "+1" are not indexes.
+func ArrayIndex(key string) (int, bool) {
+	i, err := strconv.Atoi(key)
+	if err != nil || i < 0 || strconv.Itoa(i) != key {
+		return 0, false
+	}
+	return i, true
+}
+
+// plainArray tells if t is an array with nothing besides its elements,
+// so it can be represented as a JSON array.
+func (t Tree) plainArray() bool {
+	if !t.Array || t.Leaf.Kind != UNDEFINED || t.Key != "" || t.Rev != "" ||
+		t.Map != "" || t.MapDepth != 0 || t.Reduce != "" || t.Deleted || t.Doc != nil {
+		return false
+	}
+	for k := range t.Branches {
+		if _, ok := ArrayIndex(k); !ok {
+			return false
+		}
+	}
+	return true
+}
+
 func (t Tree) MarshalJSON() ([]byte, error) {
+	if t.plainArray() {
+		elements := t.Elements()
+		subts := make([][]byte, len(elements))
+		for i, element := range elements {
+			jsonElement, err := element.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			subts[i] = jsonElement
+		}
+		out := append([]byte{'['}, bytes.Join(subts, []byte{','})...)
+		out = append(out, ']')
+		return out, nil
+	}
+
 	var parts [][]byte
 
 	// current leaf
@@ -122,6 +225,13 @@ func (t Tree) MarshalJSON() ([]byte, error) {
 		parts = append(parts, buffer.Bytes())
 	}
 
+	// map depth
+	if t.MapDepth != 0 {
+		buffer := bytes.NewBufferString(`"!mapdepth":`)
+		buffer.WriteString(strconv.Itoa(t.MapDepth))
+		parts = append(parts, buffer.Bytes())
+	}
+
 	// reduce
 	if t.Reduce != "" {
 		buffer := bytes.NewBufferString(`"!reduce":`)
@@ -136,6 +246,22 @@ func (t Tree) MarshalJSON() ([]byte, error) {
 		parts = append(parts, buffer.Bytes())
 	}
 
+	// array
+	if t.Array {
+		parts = append(parts, []byte(`"_arr":true`))
+	}
+
+	// source document
+	if t.Doc != nil {
+		jsonDoc, err := t.Doc.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		buffer := bytes.NewBufferString(`"_doc":`)
+		buffer.Write(jsonDoc)
+		parts = append(parts, buffer.Bytes())
+	}
+
 	// all branches
 	if len(t.Branches) > 0 {
 		subts := make([][]byte, len(t.Branches))
@@ -145,7 +271,7 @@ func (t Tree) MarshalJSON() ([]byte, error) {
 			if err != nil {
 				return nil, err
 			}
-			subts[i] = append([]byte(`"`+strings.Replace(k, `"`, `\"`, -1)+`":`), jsonLeaf...)
+			subts[i] = append(append(utils.JSONString(jsonKey(k)), ':'), jsonLeaf...)
 			i++
 		}
 		joinedbranches := bytes.Join(subts, []byte{','})
@@ -201,14 +327,38 @@ func (t Tree) ToInterface() map[string]interface{} {
 		o["!map"] = t.Map
 	}
 
+	// map depth
+	if t.MapDepth != 0 {
+		o["!mapdepth"] = t.MapDepth
+	}
+
 	// deleted
 	if t.Deleted {
 		o["_del"] = t.Deleted
 	}
 
+	// array
+	if t.Array {
+		o["_arr"] = true
+	}
+
+	// source document
+	if t.Doc != nil {
+		o["_doc"] = t.Doc.ToInterface()
+	}
+
 	// all branches
 	for subkey, branch := range t.Branches {
-		o[subkey] = branch.ToInterface()
+		if branch.plainArray() {
+			elements := branch.Elements()
+			array := make([]interface{}, len(elements))
+			for i, element := range elements {
+				array[i] = element.ToInterface()
+			}
+			o[subkey] = array
+		} else {
+			o[subkey] = branch.ToInterface()
+		}
 	}
 
 	return o
@@ -1,6 +1,8 @@
 package types
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
 	. "github.com/summadb/summadb/utils"
@@ -36,7 +38,7 @@ func (s *TypesSuite) TestUnmarshalJSON(c *C) {
 		},
 	})
 	c.Assert(TreeFromJSON(`92`), DeepEquals, Tree{
-		Leaf: NumberLeaf(92),
+		Leaf: IntegerLeaf(92),
 	})
 	c.Assert(TreeFromJSON(`{"a": {"f": false, "n": null, "m": {"t": true}}}`), DeepEquals, Tree{
 		Branches: Branches{
@@ -64,7 +66,7 @@ func (s *TypesSuite) TestUnmarshalJSON(c *C) {
 		TreeFromJSON(`{"_val": 12, "_rev": "2-oweqwe", "!map": "emit(1, 2)", "_del": false}`),
 		DeepEquals,
 		Tree{
-			Leaf:     NumberLeaf(12),
+			Leaf:     IntegerLeaf(12),
 			Rev:      "2-oweqwe",
 			Map:      "emit(1, 2)",
 			Deleted:  false,
@@ -100,10 +102,15 @@ func (s *TypesSuite) TestMarshalJSON(c *C) {
 	c.Assert(j, DeepEquals, []byte(`{"a":{"_val":"b"}}`))
 
 	j, _ = (Tree{
-		Leaf: NumberLeaf(92),
+		Leaf: IntegerLeaf(92),
 	}).MarshalJSON()
 	c.Assert(j, DeepEquals, []byte(`{"_val":92}`))
 
+	j, _ = (Tree{
+		Leaf: NumberLeaf(92),
+	}).MarshalJSON()
+	c.Assert(j, DeepEquals, []byte(`{"_val":92.0}`))
+
 	j, _ = (Tree{
 		Leaf: StringLeaf("www"),
 		Branches: Branches{
@@ -163,4 +170,156 @@ func (s *TypesSuite) TestMarshalJSON(c *C) {
 func (s *TypesSuite) TestPath(c *C) {
 	c.Assert(ParsePath("fruits/banana"), DeepEquals, Path{"fruits", "banana"})
 	c.Assert(ParsePath("fruits/banana/color").RelativeTo(ParsePath("fruits")), DeepEquals, Path{"banana", "color"})
+
+	c.Assert(ParsePath("fruits/!map").WriteValid(), Equals, true)
+	c.Assert(ParsePath("fruits/!map/x").WriteValid(), Equals, true)
+	c.Assert(ParsePath("fruits/!map/x").InsideView(), Equals, true)
+	c.Assert(ParsePath("fruits/!map").InsideView(), Equals, false)
+	c.Assert(ParsePath("fruits/!reduce/x").WriteValid(), Equals, false)
+	c.Assert(ParsePath("fruits/!lib/slugify").WriteValid(), Equals, true)
+	c.Assert(ParsePath("!lib/slugify").WriteValid(), Equals, true)
+	c.Assert(ParsePath("!lib/slugify/x").WriteValid(), Equals, false)
+	c.Assert(ParsePath("fruits/_rev").WriteValid(), Equals, false)
+	c.Assert(ParsePath("fruits/!map/x/!map").WriteValid(), Equals, true)
+	c.Assert(ParsePath("fruits/!map/x/!reduce").WriteValid(), Equals, true)
+	c.Assert(ParsePath("fruits/!map/x/!map/y").WriteValid(), Equals, true)
+	c.Assert(ParsePath("fruits/!map/x/y").WriteValid(), Equals, false)
+	c.Assert(ParsePath("fruits/!map/x/!mapdepth").WriteValid(), Equals, false)
+	c.Assert(ParsePath("fruits/!map/x/!lib/slugify").WriteValid(), Equals, false)
+	c.Assert(ParsePath("fruits/!map/!map/x").WriteValid(), Equals, false)
+}
+
+func (s *TypesSuite) TestArrays(c *C) {
+	tree := TreeFromJSON(`{"tags": ["a", {"name": "b"}, ["c"]]}`)
+	c.Assert(tree, DeepEquals, Tree{
+		Branches: Branches{
+			"tags": &Tree{
+				Array: true,
+				Branches: Branches{
+					"0": &Tree{Leaf: StringLeaf("a")},
+					"1": &Tree{Branches: Branches{"name": &Tree{Leaf: StringLeaf("b")}}},
+					"2": &Tree{Array: true, Branches: Branches{"0": &Tree{Leaf: StringLeaf("c")}}},
+				},
+			},
+		},
+	})
+
+	j, _ := tree.MarshalJSON()
+	c.Assert(j, JSONEquals, `{"tags": [{"_val": "a"}, {"name": {"_val": "b"}}, [{"_val": "c"}]]}`)
+	c.Assert(TreeFromJSON(string(j)), DeepEquals, TreeFromJSON(`{"tags": [{"_val": "a"}, {"name": {"_val": "b"}}, [{"_val": "c"}]]}`))
+
+	// elements are ordered by their index, deleted ones are skipped
+	tree = Tree{
+		Array: true,
+		Branches: Branches{
+			"10": &Tree{Leaf: NumberLeaf(3)},
+			"2":  &Tree{Leaf: NumberLeaf(2)},
+			"1":  &Tree{Leaf: NumberLeaf(1), Deleted: true},
+			"0":  &Tree{Leaf: NumberLeaf(1)},
+		},
+	}
+	elements := tree.Elements()
+	c.Assert(elements, HasLen, 3)
+	c.Assert(elements[0].Leaf, DeepEquals, NumberLeaf(1))
+	c.Assert(elements[2].Leaf, DeepEquals, NumberLeaf(3))
+
+	// arrays with metadata are objects
+	tree.Rev = "1-abc"
+	j, _ = tree.MarshalJSON()
+	parsed := TreeFromJSON(string(j))
+	c.Assert(parsed.Array, Equals, true)
+	c.Assert(parsed.Rev, Equals, "1-abc")
+	c.Assert(parsed.Branches["10"].Leaf, DeepEquals, NumberLeaf(3))
+
+	// only canonical indexes are elements, and arrays with other keys are objects
+	tree = Tree{
+		Array: true,
+		Branches: Branches{
+			"0":  &Tree{Leaf: NumberLeaf(1)},
+			"01": &Tree{Leaf: NumberLeaf(2)},
+			"+1": &Tree{Leaf: NumberLeaf(3)},
+		},
+	}
+	c.Assert(tree.Elements(), HasLen, 1)
+	j, err := tree.MarshalJSON()
+	c.Assert(err, IsNil)
+	c.Assert(j, JSONEquals, `{"_arr": true, "0": {"_val": 1}, "01": {"_val": 2}, "+1": {"_val": 3}}`)
+	_, ok := ArrayIndex("-0")
+	c.Assert(ok, Equals, false)
+}
+
+func (s *TypesSuite) TestNumbers(c *C) {
+	c.Assert(NumberLeaf(12).Kind, Equals, byte(NUMBER))
+	c.Assert(NumberLeaf(12.5).Kind, Equals, byte(NUMBER))
+	c.Assert(TreeFromJSON(`12.0`).Leaf, DeepEquals, NumberLeaf(12))
+
+	// integers and floats keep all their digits
+	tree := TreeFromJSON(`{"id": 9007199254740993, "price": 0.1, "ratio": 3.141592653589793}`)
+	c.Assert(tree.Branches["id"].Leaf, DeepEquals, IntegerLeaf(9007199254740993))
+	c.Assert(tree.Branches["price"].Leaf, DeepEquals, NumberLeaf(0.1))
+	j, _ := tree.Branches["ratio"].Leaf.MarshalJSON()
+	c.Assert(string(j), Equals, "3.141592653589793")
+	j, _ = tree.Branches["id"].Leaf.MarshalJSON()
+	c.Assert(string(j), Equals, "9007199254740993")
+
+	// numbers that don't fit are decimals
+	tree = TreeFromJSON(`{"big": 123456789012345678901234567890, "money": 1234567890123456.78}`)
+	c.Assert(tree.Branches["big"].Leaf, DeepEquals, DecimalLeaf("123456789012345678901234567890"))
+	c.Assert(tree.Branches["money"].Leaf, DeepEquals, DecimalLeaf("1234567890123456.78"))
+	j, _ = tree.MarshalJSON()
+	c.Assert(string(j), Matches, `.*"_val":1234567890123456.78.*`)
+	c.Assert(DecimalLeaf("not a number"), DeepEquals, NullLeaf())
+	c.Assert(DecimalLeaf("1/3"), DeepEquals, NullLeaf())
+	c.Assert(DecimalLeaf("0x1p4"), DeepEquals, NullLeaf())
+	c.Assert(DecimalLeaf("01"), DeepEquals, NullLeaf())
+	c.Assert(DecimalLeaf("-1.5e+700").Kind, Equals, byte(DECIMAL))
+	c.Assert(TreeFromJSON(`1e1000001`).Leaf, DeepEquals, DecimalLeaf("1e1000001"))
+}
+
+func (s *TypesSuite) TestKeyEscaping(c *C) {
+	for _, key := range []string{
+		"http://example.com/a?b=c", " padded ", "_rev", "!map", "100%", "", "ação/ñ", "a:b",
+	} {
+		segment := EscapeKey(key)
+		c.Assert(UnescapeKey(segment), Equals, key)
+		c.Assert(strings.Contains(segment, "/"), Equals, false)
+		c.Assert(PathFromKeys("x", key).WriteValid(), Equals, true)
+		c.Assert(ParsePath(PathFromKeys("x", key).Join()).Keys(), DeepEquals, []string{"x", key})
+	}
+	c.Assert(EscapeKey("_rev"), Equals, "%5Frev")
+	c.Assert(EscapeKey(" a b "), Equals, "%20a b%20")
+	c.Assert(EscapeKey("a/b"), Equals, "a%2Fb")
+
+	// paths are made of escaped segments and are parsed as they are
+	c.Assert(ParsePath("a b/c%2Fd/!map/50%25"), DeepEquals, Path{"a b", "c%2Fd", "!map", "50%25"})
+	c.Assert(ParsePath("a b/c%2Fd/!map/50%25").Keys(), DeepEquals, []string{"a b", "c/d", "!map", "50%"})
+	c.Assert(ParsePath(PathFromKeys("https://x.com/?q=a%2Fb", "100%25", "%").Join()).Keys(),
+		DeepEquals, []string{"https://x.com/?q=a%2Fb", "100%25", "%"})
+
+	// in JSON, paths can be arrays of raw keys or strings and tree keys are raw
+	var p Path
+	c.Assert(json.Unmarshal([]byte(`["urls", "http://x", "100%", " a ", ""]`), &p), IsNil)
+	c.Assert(p, DeepEquals, PathFromKeys("urls", "http://x", "100%", " a ", ""))
+	c.Assert(p.Keys(), DeepEquals, []string{"urls", "http://x", "100%", " a ", ""})
+	c.Assert(json.Unmarshal([]byte(`["urls", "_rev"]`), &p), ErrorMatches, "special keys .*: _rev")
+	c.Assert(json.Unmarshal([]byte(`["urls", "!map"]`), &p), ErrorMatches, "special keys .*: !map")
+	c.Assert(json.Unmarshal([]byte(`["urls", 1]`), &p), NotNil)
+	c.Assert(json.Unmarshal([]byte(`"urls/%5Fid"`), &p), IsNil)
+	c.Assert(p.Keys(), DeepEquals, []string{"urls", "_id"})
+
+	tree := TreeFromJSON(`{"_id": {"_val": 1}, "a/b": 2, "%": 3, "100%25": 4, "_rev": "1-x"}`)
+	c.Assert(tree.Rev, Equals, "1-x")
+	c.Assert(tree.Branches["%5Fid"].Leaf, DeepEquals, IntegerLeaf(1))
+	c.Assert(tree.Branches["a%2Fb"].Leaf, DeepEquals, IntegerLeaf(2))
+	c.Assert(tree.Branches["%25"].Leaf, DeepEquals, IntegerLeaf(3))
+	c.Assert(tree.Branches["100%2525"].Leaf, DeepEquals, IntegerLeaf(4))
+
+	// and come back the same
+	j, _ := tree.MarshalJSON()
+	var back map[string]interface{}
+	c.Assert(json.Unmarshal(j, &back), IsNil)
+	c.Assert(back["_id"], DeepEquals, map[string]interface{}{"_val": 1.0})
+	c.Assert(back["a/b"], DeepEquals, map[string]interface{}{"_val": 2.0})
+	c.Assert(back["%"], DeepEquals, map[string]interface{}{"_val": 3.0})
+	c.Assert(back["100%25"], DeepEquals, map[string]interface{}{"_val": 4.0})
 }
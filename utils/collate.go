@@ -2,6 +2,8 @@ package utils
 
 import (
 	"bytes"
+	"encoding/json"
+	"math/big"
 	"reflect"
 	"strconv"
 	"strings"
@@ -21,7 +23,7 @@ func collationIndex(x interface{}) byte {
 	switch x.(type) {
 	case bool:
 		return '2'
-	case float64, int:
+	case float64, int, int64, json.Number:
 		return '3'
 	case string:
 		return '4'
@@ -45,7 +47,11 @@ func indexify(key interface{}) (result []byte) {
 	case float64:
 		return numToIndexable(k)
 	case int:
-		return numToIndexable(float64(k))
+		return decimalToIndexable(strconv.Itoa(k))
+	case int64:
+		return decimalToIndexable(strconv.FormatInt(k, 10))
+	case json.Number:
+		return decimalToIndexable(string(k))
 	case string:
 		return bytes.Replace(
 			bytes.Replace(
@@ -74,12 +80,36 @@ func numToIndexable(num float64) (result []byte) {
 		return []byte{'1'}
 	}
 
+	// the shortest representation that parses back to the same float
+	return decimalToIndexable(strconv.FormatFloat(num, 'e', -1, 64))
+}
+
+// decimalToIndexable collates a number written in decimal notation, like
+// "-12.5", "1e+40" or an integer too big for float64, without rounding it.
+func decimalToIndexable(num string) (result []byte) {
+	neg := strings.HasPrefix(num, "-")
+	num = strings.TrimLeft(num, "+-")
+
 	// convert number to exponential format for easier and
 	// more succinct string sorting
-	expFormat := strings.Split(strconv.FormatFloat(num, 'e', -1, 64), "e+")
-	magnitude, _ := strconv.Atoi(expFormat[1])
-
-	neg := num < 0
+	exponent := 0
+	if e := strings.IndexAny(num, "eE"); e != -1 {
+		exponent, _ = strconv.Atoi(strings.TrimPrefix(num[e+1:], "+"))
+		num = num[:e]
+	}
+	if dot := strings.Index(num, "."); dot != -1 {
+		exponent += dot - 1
+		num = num[:dot] + num[dot+1:]
+	} else {
+		exponent += len(num) - 1
+	}
+	digits := strings.TrimLeft(num, "0")
+	exponent -= len(num) - len(digits)
+	digits = strings.TrimRight(digits, "0")
+	if digits == "" {
+		return []byte{'1'}
+	}
+	magnitude := exponent
 
 	if neg {
 		result = append(result, '0')
@@ -89,26 +119,50 @@ func numToIndexable(num float64) (result []byte) {
 	}
 
 	// first sort by magnitude
-	// it's easier if all magnitudes are positive
-	magnitudeString := strconv.Itoa(magnitude + 324)
-	pad := 3 - len(magnitudeString)
-	magnitudeString = strings.Repeat("0", pad) + magnitudeString
-
-	result = append(result, []byte(magnitudeString)...)
+	result = append(result, magnitudeToIndexable(magnitude+324)...)
 
 	// then sort by the factor
-	factor, _ := strconv.ParseFloat(expFormat[0], 32) // [1..10]
+	factorStr := digits[:1]
+	if len(digits) > 1 {
+		factorStr += "." + digits[1:]
+	}
 	if neg {
 		// for negative reverse ordering
-		factor = 10 - factor
-	}
-
-	factorStr := strconv.FormatFloat(factor, 'f', -1, 64)
+		factor, _ := new(big.Rat).SetString(factorStr)
+		factor.Sub(big.NewRat(10, 1), factor)
+		factorStr = factor.FloatString(len(digits) - 1)
 
-	// strip zeros from the end
-	factorStr = strings.TrimRight(factorStr, "0.")
+		// strip zeros from the end
+		if strings.Contains(factorStr, ".") {
+			factorStr = strings.TrimRight(factorStr, "0.")
+		}
+	}
 
 	result = append(result, []byte(factorStr)...)
 
 	return result
 }
+
+// magnitudeToIndexable collates the magnitudes of numbers, offset so the ones
+// float64 can have are 3 digits. the others, which only decimals written
+// in full can have, come after "999" or "000" followed by the number of their
+// digits as a letter, then the digits, so they sort among themselves and
+// before or after any factor that comes after the 3 digits. below zero,
+// they are reversed to sort the other way around, and "-" sorts before
+// the factors of negative numbers, which may start with "0".
+func magnitudeToIndexable(m int) []byte {
+	switch {
+	case m > 999:
+		digits := strconv.Itoa(m - 999)
+		return []byte("999" + string(rune('a'+len(digits)-1)) + digits)
+	case m < 0:
+		digits := []byte(strconv.Itoa(-m))
+		for i, d := range digits {
+			digits[i] = '9' - (d - '0')
+		}
+		return []byte("000-" + string(rune('z'-len(digits)+1)) + string(digits))
+	default:
+		digits := strconv.Itoa(m)
+		return []byte(strings.Repeat("0", 3-len(digits)) + digits)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"encoding/json"
 	"testing"
 
 	. "gopkg.in/check.v1"
@@ -30,3 +31,45 @@ func (s *UtilsSuite) TestCollate(c *C) {
 	c.Assert(func() { ToIndexable([]float64{37.23, 16.6, 12}) }, PanicMatches, ".*does not work.*")
 	c.Assert(func() { ToIndexable(map[string]interface{}{"xi": "lascou"}) }, PanicMatches, ".*does not work.*")
 }
+
+func (s *UtilsSuite) TestCollateNumbers(c *C) {
+	ordered := []interface{}{
+		json.Number("-1e+700"),
+		json.Number("-9e+675"),
+		json.Number("-1e+400"),
+		json.Number("-1e+30"),
+		float64(-100),
+		int64(-99),
+		float64(-1.5),
+		float64(-0.25),
+		json.Number("-9.5e-324"),
+		json.Number("-2e-325"),
+		json.Number("-1e-400"),
+		json.Number("-1e-700"),
+		int64(0),
+		json.Number("1e-700"),
+		json.Number("1e-400"),
+		json.Number("2e-325"),
+		json.Number("9.5e-324"),
+		float64(0.001),
+		float64(0.5),
+		int64(1),
+		json.Number("1.0000000000000000000001"),
+		float64(1.5),
+		int64(9007199254740992),
+		int64(9007199254740993),
+		json.Number("123456789012345678901234567890"),
+		json.Number("9e+675"),
+		json.Number("1e+676"),
+		json.Number("1e+700"),
+		json.Number("1e+7000"),
+	}
+	for i := 1; i < len(ordered); i++ {
+		c.Assert(string(ToIndexable(ordered[i-1])) < string(ToIndexable(ordered[i])), Equals, true,
+			Commentf("%v < %v", ordered[i-1], ordered[i]))
+	}
+
+	// the same number collates the same regardless of its type
+	c.Assert(ToIndexable(float64(42)), DeepEquals, ToIndexable(int64(42)))
+	c.Assert(ToIndexable(float64(0.75)), DeepEquals, ToIndexable(json.Number("0.750")))
+}
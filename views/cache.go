@@ -0,0 +1,71 @@
+package views
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+)
+
+// CompiledCacheSize is how many compiled functions are kept for each language.
+var CompiledCacheSize = 512
+
+// codeCache keeps the compiled form of the most recently used view functions,
+// keyed by the hash of their source code.
+type codeCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*list.Element
+	order   *list.List // most recently used first
+}
+
+type cacheEntry struct {
+	hash     [sha256.Size]byte
+	compiled interface{}
+}
+
+func newCodeCache() *codeCache {
+	return &codeCache{
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the compiled form of code, compiling it only if it isn't cached.
+// failed compilations are not cached.
+func (c *codeCache) get(code string, compile func(string) (interface{}, error)) (interface{}, error) {
+	hash := sha256.Sum256([]byte(code))
+
+	c.mu.Lock()
+	if element, ok := c.entries[hash]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*cacheEntry).compiled, nil
+	}
+	c.mu.Unlock()
+
+	compiled, err := compile(code)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[hash]; ok {
+		// compiled by someone else in the meantime
+		c.order.MoveToFront(element)
+		return element.Value.(*cacheEntry).compiled, nil
+	}
+	c.entries[hash] = c.order.PushFront(&cacheEntry{hash, compiled})
+	for c.order.Len() > CompiledCacheSize {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).hash)
+	}
+	return compiled, nil
+}
+
+// len tells how many compiled functions are cached.
+func (c *codeCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
@@ -0,0 +1,27 @@
+package views
+
+import (
+	"strings"
+
+	"github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// compiled function protos. protos are immutable, so the same one can be
+// shared by all lua states.
+var protoCache = newCodeCache()
+
+// compile parses and compiles code only when it isn't in the cache.
+func compile(code string) (*lua.FunctionProto, error) {
+	proto, err := protoCache.get(code, func(code string) (interface{}, error) {
+		chunk, err := parse.Parse(strings.NewReader(code), "<view>")
+		if err != nil {
+			return nil, err
+		}
+		return lua.Compile(chunk, "<view>")
+	})
+	if err != nil {
+		return nil, err
+	}
+	return proto.(*lua.FunctionProto), nil
+}
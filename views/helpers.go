@@ -1,6 +1,8 @@
 package views
 
 import (
+	"strings"
+
 	"github.com/summadb/summadb/types"
 	"github.com/yuin/gopher-lua"
 )
@@ -35,30 +37,55 @@ func lvalueToInterface(lvalue lua.LValue) interface{} {
 	return nil
 }
 
-func treeToLTable(L *lua.LState, t types.Tree) *lua.LTable {
-	table := L.CreateTable(32, 32)
-
-	for key, subtree := range t.Branches {
-		subtable := treeToLTable(L, *subtree)
-		table.RawSetString(key, subtable)
-	}
+// rawKey is the key of a document as views see it: its path relative to
+// the view, with the keys unescaped.
+func rawKey(key string) string {
+	return strings.Join(types.ParsePath(key).Keys(), "/")
+}
 
+// treeToLTable fills table with the branches and the leaf value of t.
+// the elements of arrays are stored in the array part of the table.
+func treeToLTable(L *lua.LState, table *lua.LTable, t types.Tree) {
 	var leafvalue lua.LValue
 	switch t.Leaf.Kind {
 	case types.STRING:
 		leafvalue = lua.LString(t.Leaf.String())
 	case types.NUMBER:
 		leafvalue = lua.LNumber(t.Leaf.Number())
+	case types.INTEGER, types.DECIMAL:
+		// lua numbers are float64, so numbers they can't hold
+		// exactly are given as strings. being strings, 'indexify' collates
+		// them as strings too: tonumber() must be called on them first to
+		// collate them with other numbers, at the cost of their precision.
+		if t.Leaf.Exact() {
+			leafvalue = lua.LNumber(t.Leaf.Number())
+		} else {
+			digits, _ := t.Leaf.MarshalJSON()
+			leafvalue = lua.LString(digits)
+		}
 	case types.BOOL:
 		leafvalue = lua.LBool(t.Leaf.Bool())
 	case types.NULL:
 		leafvalue = lua.LNil
-	default:
-		return table
 	}
-	table.RawSetString("_val", leafvalue)
+	if leafvalue != nil {
+		table.RawSetString("_val", leafvalue)
+	}
 
-	return table
+	if t.Array {
+		for i, element := range t.Elements() {
+			subtable := L.CreateTable(32, 32)
+			treeToLTable(L, subtable, *element)
+			table.RawSetInt(i+1 /* lua tables are 1-indexed */, subtable)
+		}
+		return
+	}
+
+	for key, subtree := range t.Branches {
+		subtable := L.CreateTable(32, 32)
+		treeToLTable(L, subtable, *subtree)
+		table.RawSetString(types.UnescapeKey(key), subtable)
+	}
 }
 
 // toArray returns nil if the table is not a proper array.
@@ -77,3 +104,64 @@ func toArray(table *lua.LTable) []interface{} {
 	}
 	return array
 }
+
+// treeToInterface is the javascript counterpart of treeToLTable. arrays,
+// the doc itself included, are given as javascript arrays of their elements.
+func treeToInterface(t types.Tree) interface{} {
+	if t.Array {
+		elements := t.Elements()
+		array := make([]interface{}, len(elements))
+		for i, element := range elements {
+			array[i] = treeToInterface(*element)
+		}
+		return array
+	}
+
+	o := make(map[string]interface{}, len(t.Branches)+1)
+
+	switch t.Leaf.Kind {
+	case types.STRING:
+		o["_val"] = t.Leaf.String()
+	case types.NUMBER:
+		o["_val"] = t.Leaf.Number()
+	case types.INTEGER:
+		o["_val"] = t.Leaf.Int()
+	case types.DECIMAL:
+		// javascript numbers can't hold it exactly
+		o["_val"] = t.Leaf.String()
+	case types.BOOL:
+		o["_val"] = t.Leaf.Bool()
+	case types.NULL:
+		o["_val"] = nil
+	}
+
+	for key, subtree := range t.Branches {
+		o[types.UnescapeKey(key)] = treeToInterface(*subtree)
+	}
+	return o
+}
+
+// jsToInterface normalizes values exported from javascript to the types
+// lvalueToInterface returns. goja exports integral numbers as integers, but
+// they are floats in javascript as they are in lua.
+func jsToInterface(v interface{}) interface{} {
+	switch value := v.(type) {
+	case int:
+		return float64(value)
+	case int64:
+		return float64(value)
+	case []interface{}:
+		array := make([]interface{}, len(value))
+		for i, item := range value {
+			array[i] = jsToInterface(item)
+		}
+		return array
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			m[k] = jsToInterface(item)
+		}
+		return m
+	}
+	return v
+}
@@ -95,3 +95,68 @@ func (s *HelpersSuite) TestTypeConversion(c *C) {
 
 	c.Assert(table3, DeepEquals, table3expected)
 }
+
+func (s *HelpersSuite) TestArrayConversion(c *C) {
+	L := lua.NewState()
+	defer L.Close()
+
+	tree := types.Tree{
+		Branches: types.Branches{
+			"places": &types.Tree{
+				Array: true,
+				Branches: types.Branches{
+					"1": &types.Tree{Leaf: types.StringLeaf("brazil")},
+					"0": &types.Tree{Leaf: types.StringLeaf("equador")},
+				},
+			},
+		},
+	}
+	table := L.CreateTable(32, 32)
+	treeToLTable(L, table, tree)
+
+	places := table.RawGetString("places").(*lua.LTable)
+	c.Assert(places.Len(), Equals, 2)
+	c.Assert(places.RawGetInt(1).(*lua.LTable).RawGetString("_val"), Equals, lua.LString("equador"))
+	c.Assert(places.RawGetInt(2).(*lua.LTable).RawGetString("_val"), Equals, lua.LString("brazil"))
+
+	// and back
+	back := types.TreeFromInterface(lvalueToInterface(table))
+	c.Assert(back.Branches["places"].Array, Equals, true)
+	c.Assert(back.Branches["places"].Branches["0"].Leaf, DeepEquals, types.StringLeaf("equador"))
+	c.Assert(back.Branches["places"].Branches["1"].Leaf, DeepEquals, types.StringLeaf("brazil"))
+
+	// javascript sees a proper array
+	o := treeToInterface(tree).(map[string]interface{})
+	c.Assert(o["places"], DeepEquals, []interface{}{
+		map[string]interface{}{"_val": "equador"},
+		map[string]interface{}{"_val": "brazil"},
+	})
+	back = types.TreeFromInterface(o)
+	c.Assert(back.Branches["places"].Array, Equals, true)
+	c.Assert(back.Branches["places"].Elements(), HasLen, 2)
+}
+
+func (s *HelpersSuite) TestNumberConversion(c *C) {
+	L := lua.NewState()
+	defer L.Close()
+
+	table := L.CreateTable(32, 32)
+	treeToLTable(L, table, types.Tree{
+		Branches: types.Branches{
+			"small": &types.Tree{Leaf: types.IntegerLeaf(42)},
+			"id":    &types.Tree{Leaf: types.IntegerLeaf(9007199254740993)},
+			"money": &types.Tree{Leaf: types.DecimalLeaf("0.10000000000000000001")},
+		},
+	})
+
+	// numbers lua can't hold exactly are given as strings
+	get := func(key string) lua.LValue { return table.RawGetString(key).(*lua.LTable).RawGetString("_val") }
+	c.Assert(get("small"), Equals, lua.LNumber(42))
+	c.Assert(get("id"), Equals, lua.LString("9007199254740993"))
+	c.Assert(get("money"), Equals, lua.LString("0.10000000000000000001"))
+
+	o := treeToInterface(types.Tree{
+		Branches: types.Branches{"id": &types.Tree{Leaf: types.IntegerLeaf(9007199254740993)}},
+	}).(map[string]interface{})
+	c.Assert(o["id"].(map[string]interface{})["_val"], Equals, int64(9007199254740993))
+}
@@ -0,0 +1,40 @@
+package views
+
+import "strings"
+
+const (
+	LUA        = "lua"
+	JAVASCRIPT = "js"
+	GO         = "go" // the body is the name of a function registered in the database package
+)
+
+// Language reads the optional header line of a map or reduce function, like
+//
+//	#!js
+//	emit(doc.kind._val, _key, 1)
+//
+// and returns the declared language and the code without the header.
+// code without a header is lua.
+func Language(code string) (lang string, body string) {
+	trimmed := strings.TrimLeft(code, " \t\r\n")
+	if !strings.HasPrefix(trimmed, "#!") {
+		return LUA, code
+	}
+
+	header := trimmed[2:]
+	body = ""
+	if nl := strings.Index(header, "\n"); nl != -1 {
+		header, body = header[:nl], header[nl+1:]
+	}
+
+	// anything after the language name on the header line is part of the body.
+	fields := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	lang = strings.ToLower(fields[0])
+	if len(fields) == 2 {
+		body = strings.TrimSpace(fields[1]) + "\n" + body
+	}
+	if lang == "javascript" {
+		lang = JAVASCRIPT
+	}
+	return lang, body
+}
@@ -0,0 +1,297 @@
+package views
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/dop251/goja"
+	"github.com/summadb/summadb/types"
+	"github.com/summadb/summadb/utils"
+)
+
+// compiled javascript programs, which can be shared by all runtimes.
+var programCache = newCodeCache()
+
+// compileJS compiles code only when it isn't in the cache.
+func compileJS(code string) (*goja.Program, error) {
+	program, err := programCache.get(code, func(code string) (interface{}, error) {
+		return goja.Compile("<view>", code, false)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return program.(*goja.Program), nil
+}
+
+// newJSRuntime creates a javascript runtime with the same deterministic time
+// and random sources as the lua sandbox and the 'indexify' function.
+func newJSRuntime(seed string) *goja.Runtime {
+	vm := goja.New()
+	vm.SetMaxCallStackSize(DefaultLimits.CallStackSize)
+
+	rng := rand.New(rand.NewSource(seedFromString(seed)))
+	vm.SetRandSource(rng.Float64)
+	vm.SetTimeSource(func() time.Time { return time.Unix(0, 0) })
+
+	vm.Set("indexify", func(call goja.FunctionCall) goja.Value {
+		var indexable []byte
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					panic(vm.NewTypeError("indexify: %v", r))
+				}
+			}()
+			indexable = utils.ToIndexable(jsToInterface(call.Argument(0).Export()))
+		}()
+		return vm.ToValue(string(indexable))
+	})
+
+	return vm
+}
+
+// runJS runs code in vm under the budget from DefaultLimits.
+func runJS(ctx context.Context, vm *goja.Runtime, code string) error {
+	program, err := compileJS(code)
+	if err != nil {
+		return err
+	}
+
+	b := startBudget(ctx)
+	defer b.cancel()
+	go func() {
+		<-b.ctx.Done()
+		vm.Interrupt(b.ctx.Err())
+	}()
+	guardJSAllocations(vm, b)
+
+	_, err = vm.RunProgram(program)
+	if _, overflow := err.(*goja.StackOverflowError); overflow {
+		return ErrMemory
+	}
+	if err != nil {
+		return b.explain(err)
+	}
+	return nil
+}
+
+// guardJSAllocations makes the string methods that can build a string of any
+// size check the memory budget b first, like string.rep in lua.
+func guardJSAllocations(vm *goja.Runtime, b *budget) {
+	proto := vm.Get("String").ToObject(vm).Get("prototype").ToObject(vm)
+	for _, name := range []string{"repeat", "padStart", "padEnd"} {
+		name := name
+		method, _ := goja.AssertFunction(proto.Get(name))
+		proto.Set(name, func(call goja.FunctionCall) goja.Value {
+			size := call.Argument(0).ToInteger()
+			if name == "repeat" {
+				size *= int64(len(call.This.String()))
+			}
+			if size > 0 && b.exceeds(uint64(size)) {
+				b.exhaustMemory()
+				panic(vm.NewGoError(ErrMemory))
+			}
+			result, err := method(call.This, call.Arguments...)
+			if err != nil {
+				panic(err)
+			}
+			return result
+		})
+	}
+}
+
+func mapJS(ctx context.Context, code string, t types.Tree, key string, env Env) ([]types.EmittedRow, error) {
+	vm := newJSRuntime(key)
+	get := env.Get
+
+	// the 'doc'
+	vm.Set("doc", treeToInterface(t))
+
+	// the "_key"
+	vm.Set("_key", rawKey(key))
+
+	// the 'require' function
+	if env.Require != nil {
+		setJSRequire(vm, env.Require)
+	}
+
+	// the 'get' function, takes an escaped path as a string or an array of raw keys
+	if get != nil {
+		vm.Set("get", func(call goja.FunctionCall) goja.Value {
+			var path types.Path
+			switch arg := call.Argument(0).Export().(type) {
+			case string:
+				path = types.ParsePath(arg)
+			case []interface{}:
+				for _, k := range arg {
+					path = append(path, types.EscapeKey(fmt.Sprint(k)))
+				}
+			default:
+				panic(vm.NewTypeError("get: path expected"))
+			}
+
+			tree, err := get(path)
+			if err != nil {
+				panic(vm.NewGoError(err))
+			}
+			if tree.Leaf.Kind == types.UNDEFINED && len(tree.Branches) == 0 {
+				return goja.Null()
+			}
+			return vm.ToValue(treeToInterface(tree))
+		})
+	}
+
+	// the 'emit' function, with the same semantics as the lua one.
+	var emitted []types.EmittedRow
+	vm.Set("emit", func(call goja.FunctionCall) goja.Value {
+		path := types.Path{}
+
+		// arguments are 1-indexed here, like in lua, and 'undefined' is our 'nil'.
+		get := func(n int) goja.Value {
+			arg := call.Argument(n - 1)
+			if goja.IsNull(arg) {
+				return goja.Undefined()
+			}
+			return arg
+		}
+
+		// all string arguments (except the last, if we reach it) will constitute the path
+		narg := 1
+	args:
+		for ; ; narg++ {
+			arg := get(narg)
+			if goja.IsUndefined(arg) {
+				// null, means we reached the end. the previous argument must be the value.
+				if len(path) == 0 {
+					return goja.Undefined()
+				}
+				path = path[:len(path)-1]
+				narg--
+				break
+			}
+			switch value := arg.Export().(type) {
+			case string:
+				if value == "" {
+					// the empty string is the value, like in lua.
+					break args
+				}
+			case int64, float64:
+			default:
+				// not a string or number, so this is the value.
+				break args
+			}
+
+			// a valid string, it will be part of the full path of this emitted item
+			path = append(path, types.EscapeKey(arg.String()))
+		}
+
+		var value types.Tree
+		if narg == 0 {
+			// wrong. ignore
+			return goja.Undefined()
+		} else if narg > 1 {
+			// ok, expected.
+			value = types.TreeFromInterface(jsToInterface(get(narg).Export()))
+		} else {
+			// the user has only passed 1 argument to 'emit',
+			// so use it as key and set the value to a dummy 1.
+			path = append(path, types.EscapeKey(get(narg).String()))
+			value = types.Tree{Leaf: types.NumberLeaf(1)}
+		}
+
+		emitted = append(emitted, types.EmittedRow{RelativePath: path, Value: value})
+		return goja.Undefined()
+	})
+
+	err := runJS(ctx, vm, code)
+	if err != nil {
+		return nil, err
+	}
+	return emitted, nil
+}
+
+func reduceJS(
+	ctx context.Context,
+	code string,
+	directive string,
+	acc types.Tree,
+	row types.EmittedRow,
+	key string,
+	env Env,
+) (types.Tree, error) {
+	vm := newJSRuntime(key)
+
+	// the '_key' of the original record being mapped
+	vm.Set("_key", rawKey(key))
+
+	// the 'require' function
+	if env.Require != nil {
+		setJSRequire(vm, env.Require)
+	}
+
+	// the 'path' emitted by the mapf. it is a javascript array, so its keys
+	// start at path[0], while in lua they start at path[1].
+	path := make([]interface{}, len(row.RelativePath))
+	for i, k := range row.RelativePath.Keys() {
+		path[i] = k
+	}
+	vm.Set("path", path)
+
+	// the 'value' emitted by the mapf
+	vm.Set("value", treeToInterface(row.Value))
+
+	// the 'directive': "add" or "remove"
+	vm.Set("directive", directive)
+
+	// the previous value, what is being reduced
+	vm.Set("acc", treeToInterface(acc))
+
+	err := runJS(ctx, vm, code)
+	if err != nil {
+		return types.Tree{}, err
+	}
+
+	output := vm.Get("acc").Export()
+	return types.TreeFromInterface(jsToInterface(output)), nil
+}
+
+// setJSRequire is the javascript counterpart of setRequire. the code of
+// a library is the body of a function, so it gives what it returns.
+func setJSRequire(vm *goja.Runtime, load Loader) {
+	loaded := make(map[string]goja.Value)
+	vm.Set("require", func(call goja.FunctionCall) goja.Value {
+		name := call.Argument(0).String()
+		if module, ok := loaded[name]; ok {
+			return module
+		}
+
+		code, err := load(name)
+		if err != nil {
+			panic(vm.NewGoError(fmt.Errorf("require: %s", err.Error())))
+		}
+		lang, code := Language(code)
+		if lang != JAVASCRIPT {
+			panic(vm.NewGoError(fmt.Errorf("require: library %s is not written in javascript", name)))
+		}
+		program, err := compileJS("(function () {\n" + code + "\n})")
+		if err != nil {
+			panic(vm.NewGoError(fmt.Errorf("require: %s: %s", name, err.Error())))
+		}
+
+		library, err := vm.RunProgram(program)
+		if err != nil {
+			panic(err)
+		}
+		run, _ := goja.AssertFunction(library)
+		module, err := run(goja.Undefined())
+		if err != nil {
+			panic(err)
+		}
+		if goja.IsUndefined(module) || goja.IsNull(module) {
+			module = vm.ToValue(true)
+		}
+		loaded[name] = module
+		return module
+	})
+}
@@ -0,0 +1,186 @@
+package views
+
+import (
+	"context"
+	"errors"
+
+	"github.com/summadb/summadb/types"
+	. "github.com/summadb/summadb/utils"
+	. "gopkg.in/check.v1"
+)
+
+type RunJSSuite struct{}
+
+var _ = Suite(&RunJSSuite{})
+
+// the same functions written in both languages must give the same results.
+func (s *RunJSSuite) TestRunMap(c *C) {
+	doc := types.Tree{
+		Branches: types.Branches{
+			"name": &types.Tree{
+				Leaf: types.StringLeaf("mariazinha"),
+			},
+		},
+	}
+
+	for _, test := range []struct {
+		lua      string
+		js       string
+		doc      types.Tree
+		expected []types.EmittedRow
+	}{
+		{
+			`
+emit("x", {b="name"})
+emit("y", {a=3, l={xx="xx"}})
+emit("z", 23, 18)
+emit("w", "m", "dabliuême")
+emit("r", null)
+            `, `#!js
+emit("x", {b: "name"})
+emit("y", {a: 3, l: {xx: "xx"}})
+emit("z", 23, 18)
+emit("w", "m", "dabliuême")
+emit("r", null)
+            `,
+			types.Tree{},
+			[]types.EmittedRow{
+				{RelativePath: types.Path{"x"}, Value: types.TreeFromJSON(`{"b": "name"}`)},
+				{RelativePath: types.Path{"y"}, Value: types.TreeFromJSON(`{"a": 3.0, "l": {"xx": "xx"}}`)},
+				{RelativePath: types.Path{"z", "23"}, Value: types.TreeFromJSON(`18.0`)},
+				{RelativePath: types.Path{"w", "m"}, Value: types.TreeFromJSON(`"dabliuême"`)},
+				{RelativePath: types.Path{"r"}, Value: types.TreeFromJSON(`1.0`)},
+			},
+		},
+		{
+			`emit('name-lengths', doc.name._val, string.len(doc.name._val))`,
+			`#!javascript
+emit('name-lengths', doc.name._val, doc.name._val.length)`,
+			doc,
+			[]types.EmittedRow{
+				{RelativePath: types.Path{"name-lengths", "mariazinha"}, Value: types.TreeFromJSON(`10.0`)},
+			},
+		},
+		{
+			`emit("keys", _key, indexify({doc.name._val, 3}))`,
+			`#!js
+emit("keys", _key, indexify([doc.name._val, 3]))`,
+			doc,
+			[]types.EmittedRow{
+				{RelativePath: types.Path{"keys", "k"}, Value: types.Tree{Leaf: types.StringLeaf(
+					string(ToIndexable([]interface{}{"mariazinha", 3.0})))}},
+			},
+		},
+		{
+			`emit("first", #doc, doc[1]._val)`,
+			`#!js
+emit("first", doc.length, doc[0]._val)`,
+			types.TreeFromJSON(`["a", "b"]`),
+			[]types.EmittedRow{
+				{RelativePath: types.Path{"first", "2"}, Value: types.TreeFromJSON(`"a"`)},
+			},
+		},
+		{
+			`emit("empty", "")`,
+			`#!js
+emit("empty", "")`,
+			types.Tree{},
+			[]types.EmittedRow{
+				{RelativePath: types.Path{"empty"}, Value: types.TreeFromJSON(`""`)},
+			},
+		},
+	} {
+		for _, code := range []string{test.lua, test.js} {
+			emitted, err := Map(code, test.doc, "k")
+			c.Assert(err, IsNil, Commentf(code))
+			c.Assert(emitted, DeeplyEquals, test.expected, Commentf(code))
+		}
+	}
+}
+
+func (s *RunJSSuite) TestRunReduce(c *C) {
+	row := types.EmittedRow{
+		RelativePath: types.Path{"by-kind", "fruit"},
+		Value:        types.Tree{Leaf: types.NumberLeaf(3)},
+	}
+
+	for _, reducef := range []string{`
+local kind = path[2]
+acc[kind] = acc[kind] or {_val=0}
+if directive == "add" then
+  acc[kind]._val = acc[kind]._val + value._val
+else
+  acc[kind]._val = acc[kind]._val - value._val
+end
+    `, `#!js
+var kind = path[1]
+acc[kind] = acc[kind] || {_val: 0}
+if (directive == "add") {
+  acc[kind]._val += value._val
+} else {
+  acc[kind]._val -= value._val
+}
+    `} {
+		acc, err := Reduce(reducef, "add", types.Tree{}, row, "1")
+		c.Assert(err, IsNil)
+		c.Assert(acc, DeeplyEquals, types.TreeFromJSON(`{"fruit": 3.0}`))
+
+		acc, err = Reduce(reducef, "add", acc, row, "2")
+		c.Assert(err, IsNil)
+		c.Assert(acc, DeeplyEquals, types.TreeFromJSON(`{"fruit": 6.0}`))
+
+		acc, err = Reduce(reducef, "remove", acc, row, "1")
+		c.Assert(err, IsNil)
+		c.Assert(acc, DeeplyEquals, types.TreeFromJSON(`{"fruit": 3.0}`))
+	}
+}
+
+func (s *RunJSSuite) TestRequire(c *C) {
+	loads := 0
+	env := Env{
+		Require: func(name string) (string, error) {
+			loads++
+			switch name {
+			case "slugify":
+				return `#!js
+return {slugify: function (s) { return s.toLowerCase().replace(/\s+/g, "-") }}
+                `, nil
+			case "lualib":
+				return `return {}`, nil
+			}
+			return "", errors.New("library not found: " + name)
+		},
+	}
+
+	emitted, err := MapEnv(context.Background(), `#!js
+var lib = require("slugify")
+emit("slugs", require("slugify").slugify(doc._val), true)
+    `, types.Tree{Leaf: types.StringLeaf("Dia de Sol")}, "x", env)
+	c.Assert(err, IsNil)
+	c.Assert(loads, Equals, 1)
+	c.Assert(emitted[0].RelativePath, DeepEquals, types.Path{"slugs", "dia-de-sol"})
+
+	acc, err := ReduceEnv(context.Background(), `#!js
+acc[require("slugify").slugify(path[0])] = true
+    `, "add", types.Tree{}, types.EmittedRow{RelativePath: types.Path{"A B"}}, "x", env)
+	c.Assert(err, IsNil)
+	c.Assert(acc.Branches["a-b"].Leaf, DeepEquals, types.BoolLeaf(true))
+
+	_, err = MapEnv(context.Background(), "#!js\nrequire('nothing')", types.Tree{}, "x", env)
+	c.Assert(err, ErrorMatches, "(?s).*library not found: nothing.*")
+	_, err = MapEnv(context.Background(), "#!js\nrequire('lualib')", types.Tree{}, "x", env)
+	c.Assert(err, ErrorMatches, "(?s).*not written in javascript.*")
+}
+
+func (s *RunJSSuite) TestLanguage(c *C) {
+	lang, body := Language("emit(1)")
+	c.Assert(lang, Equals, LUA)
+	c.Assert(body, Equals, "emit(1)")
+
+	lang, body = Language("\n#!js\nemit(1)")
+	c.Assert(lang, Equals, JAVASCRIPT)
+	c.Assert(body, Equals, "emit(1)")
+
+	_, err := Map("#!cobol\nDISPLAY 'x'", types.Tree{}, "")
+	c.Assert(err, ErrorMatches, "unsupported view language: cobol")
+}
@@ -1,6 +1,8 @@
 package views
 
 import (
+	"context"
+	"errors"
 	"log"
 
 	"github.com/summadb/summadb/types"
@@ -8,15 +10,97 @@ import (
 	"github.com/yuin/gopher-lua"
 )
 
+// Getter reads another record from the database, for the 'get' function
+// available to map functions.
+type Getter func(path types.Path) (types.Tree, error)
+
+// Loader fetches the code of the library called name, for 'require'.
+type Loader func(name string) (code string, err error)
+
+// Env holds the functions that give user code access to the database.
+// both are optional.
+type Env struct {
+	Get     Getter // only available to map functions
+	Require Loader
+}
+
 func Map(code string, t types.Tree, key string) ([]types.EmittedRow, error) {
-	L := lua.NewState()
-	defer L.Close()
+	return MapContext(context.Background(), code, t, key)
+}
+
+// MapContext runs a map function in a sandbox bound to ctx. When the function
+// runs out of time or memory, or ctx is cancelled, the partial output is
+// discarded and an error is returned.
+func MapContext(ctx context.Context, code string, t types.Tree, key string) ([]types.EmittedRow, error) {
+	return MapGet(ctx, code, t, key, nil)
+}
+
+// MapGet is like MapContext, but also gives the map function a 'get' function
+// that reads other records using get.
+func MapGet(ctx context.Context, code string, t types.Tree, key string, get Getter) ([]types.EmittedRow, error) {
+	return MapEnv(ctx, code, t, key, Env{Get: get})
+}
+
+// MapEnv is like MapContext, but also gives the map function the 'get'
+// and 'require' functions from env.
+func MapEnv(ctx context.Context, code string, t types.Tree, key string, env Env) ([]types.EmittedRow, error) {
+	get := env.Get
+
+	lang, code := Language(code)
+	switch lang {
+	case LUA:
+	case JAVASCRIPT:
+		return mapJS(ctx, code, t, key, env)
+	default:
+		return nil, errors.New("unsupported view language: " + lang)
+	}
+
+	s := acquireSandbox(ctx, key)
+	defer releaseSandbox(s)
+	L := s.L
 
 	// the 'doc'
-	L.SetGlobal("doc", treeToLTable(L, t))
+	doc := L.NewTable()
+	treeToLTable(L, doc, t)
+	L.SetGlobal("doc", doc)
 
 	// the "_key"
-	L.SetGlobal("_key", lua.LString(key))
+	L.SetGlobal("_key", lua.LString(rawKey(key)))
+
+	// the 'require' function
+	if env.Require != nil {
+		setRequire(L, env.Require)
+	}
+
+	// the 'get' function, takes an escaped path as a string or a table of raw keys
+	if get != nil {
+		L.SetGlobal("get", L.NewFunction(func(L *lua.LState) int {
+			var path types.Path
+			switch arg := L.Get(1).(type) {
+			case lua.LString:
+				path = types.ParsePath(string(arg))
+			case *lua.LTable:
+				arg.ForEach(func(_ lua.LValue, v lua.LValue) {
+					path = append(path, types.EscapeKey(lua.LVAsString(v)))
+				})
+			default:
+				L.ArgError(1, "path expected")
+			}
+
+			tree, err := get(path)
+			if err != nil {
+				L.RaiseError("get: %s", err.Error())
+			}
+			if tree.Leaf.Kind == types.UNDEFINED && len(tree.Branches) == 0 {
+				L.Push(lua.LNil)
+				return 1
+			}
+			record := L.NewTable()
+			treeToLTable(L, record, tree)
+			L.Push(record)
+			return 1
+		}))
+	}
 
 	// the 'emit' function
 	var emitted []types.EmittedRow
@@ -42,7 +126,7 @@ func Map(code string, t types.Tree, key string) ([]types.EmittedRow, error) {
 			// a valid string, it will be part of the full path of this emitted item
 			// if the user wants to use arrays as part of the path (i.e. keys) he can
 			// use the provided function 'indexify' on them.
-			path = append(path, arg)
+			path = append(path, types.EscapeKey(arg))
 		}
 
 		var value types.Tree
@@ -55,7 +139,7 @@ func Map(code string, t types.Tree, key string) ([]types.EmittedRow, error) {
 		} else {
 			// the user has only passed 1 argument to 'emit',
 			// so use it as key and set the value to a dummy 1.
-			path = append(path, L.ToString(narg))
+			path = append(path, types.EscapeKey(L.ToString(narg)))
 			value = types.Tree{Leaf: types.NumberLeaf(1)}
 		}
 
@@ -63,11 +147,11 @@ func Map(code string, t types.Tree, key string) ([]types.EmittedRow, error) {
 		return 0
 	}))
 
-	// the 'indexify' function
-	L.SetGlobal("indexify", createIndexify(L))
-
-	err := L.DoString(code)
-	return emitted, err
+	err := s.run(code)
+	if err != nil {
+		return nil, err
+	}
+	return emitted, nil
 }
 
 func Reduce(
@@ -77,34 +161,76 @@ func Reduce(
 	row types.EmittedRow,
 	key string,
 ) (types.Tree, error) {
-	L := lua.NewState()
-	defer L.Close()
+	return ReduceContext(context.Background(), code, directive, acc, row, key)
+}
+
+// ReduceContext runs a reduce function in a sandbox bound to ctx, like MapContext.
+func ReduceContext(
+	ctx context.Context,
+	code string,
+	directive string,
+	acc types.Tree,
+	row types.EmittedRow,
+	key string,
+) (types.Tree, error) {
+	return ReduceEnv(ctx, code, directive, acc, row, key, Env{})
+}
+
+// ReduceEnv is like ReduceContext, but also gives the reduce function
+// the 'require' function from env.
+func ReduceEnv(
+	ctx context.Context,
+	code string,
+	directive string,
+	acc types.Tree,
+	row types.EmittedRow,
+	key string,
+	env Env,
+) (types.Tree, error) {
+	lang, code := Language(code)
+	switch lang {
+	case LUA:
+	case JAVASCRIPT:
+		return reduceJS(ctx, code, directive, acc, row, key, env)
+	default:
+		return types.Tree{}, errors.New("unsupported view language: " + lang)
+	}
+
+	s := acquireSandbox(ctx, key)
+	defer releaseSandbox(s)
+	L := s.L
 
 	// the '_key' of the original record being mapped
-	L.SetGlobal("_key", lua.LString(key))
+	L.SetGlobal("_key", lua.LString(rawKey(key)))
+
+	// the 'require' function
+	if env.Require != nil {
+		setRequire(L, env.Require)
+	}
 
 	// the 'path' emitted by the mapf
 	lpath := L.CreateTable(32, 32)
-	for _, k := range row.RelativePath {
+	for _, k := range row.RelativePath.Keys() {
 		lpath.Append(lua.LString(k))
 	}
 	L.SetGlobal("path", lpath)
 
 	// the 'value' emitted by the mapf
-	L.SetGlobal("value", treeToLTable(L, row.Value))
+	value := L.NewTable()
+	treeToLTable(L, value, row.Value)
+	L.SetGlobal("value", value)
 
 	// the 'directive': "add" or "remove"
 	L.SetGlobal("directive", lua.LString(directive))
 
 	// the previous value, what is being reduced
-	L.SetGlobal("acc", treeToLTable(L, acc))
-
-	// the 'indexify' function
-	L.SetGlobal("indexify", createIndexify(L))
+	lacc := L.NewTable()
+	treeToLTable(L, lacc, acc)
+	L.SetGlobal("acc", lacc)
 
 	log.Print("running reducef: path=", row.RelativePath, " value=", row.Value, " directive=", directive, " acc=", acc)
 
-	err := L.DoString(code)
+	err := s.run(code)
 	if err != nil {
 		return types.Tree{}, err
 	}
@@ -113,6 +239,44 @@ func Reduce(
 	return types.TreeFromInterface(lvalueToInterface(output)), nil
 }
 
+// setRequire installs a 'require' function that runs the code of libraries
+// fetched by load, once per run, and returns what they return.
+func setRequire(L *lua.LState, load Loader) {
+	loaded := L.NewTable()
+	L.SetGlobal("require", L.NewFunction(func(L *lua.LState) int {
+		name := L.CheckString(1)
+		if module := loaded.RawGetString(name); module != lua.LNil {
+			L.Push(module)
+			return 1
+		}
+
+		code, err := load(name)
+		if err != nil {
+			L.RaiseError("require: %s", err.Error())
+		}
+		lang, code := Language(code)
+		if lang != LUA {
+			L.RaiseError("require: library %s is not written in lua", name)
+		}
+		proto, err := compile(code)
+		if err != nil {
+			L.RaiseError("require: %s: %s", name, err.Error())
+		}
+
+		L.Push(L.NewFunctionFromProto(proto))
+		L.Call(0, 1)
+		module := L.Get(-1)
+		L.Pop(1)
+		if module == lua.LNil {
+			module = lua.LTrue
+		}
+		loaded.RawSetString(name, module)
+
+		L.Push(module)
+		return 1
+	}))
+}
+
 func createIndexify(L *lua.LState) lua.LValue {
 	return L.NewFunction(func(L *lua.LState) int {
 		/* return after converting to string from ToIndexable []byte the first argument */
@@ -1,6 +1,8 @@
 package views
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/summadb/summadb/types"
@@ -29,14 +31,14 @@ emit("r", null)
 	c.Assert(emitted, DeeplyEquals, []types.EmittedRow{
 		types.EmittedRow{types.Path{"x"}, types.TreeFromJSON(`{"b": "name"}`)},
 		types.EmittedRow{types.Path{"y"}, types.TreeFromJSON(`{
-            "a": 3,
+            "a": 3.0,
             "l": {
               "xx": "xx"
             }
 		}`)},
-		types.EmittedRow{types.Path{"z", "23"}, types.TreeFromJSON(`18`)},
+		types.EmittedRow{types.Path{"z", "23"}, types.TreeFromJSON(`18.0`)},
 		types.EmittedRow{types.Path{"w", "m"}, types.TreeFromJSON(`"dabliuême"`)},
-		types.EmittedRow{types.Path{"r"}, types.TreeFromJSON(`1`)},
+		types.EmittedRow{types.Path{"r"}, types.TreeFromJSON(`1.0`)},
 	})
 
 	emitted, err = Map(`
@@ -51,6 +53,76 @@ emit('name-lengths', doc.name._val, string.len(doc.name._val))
 
 	c.Assert(err, IsNil)
 	c.Assert(emitted, DeeplyEquals, []types.EmittedRow{
-		types.EmittedRow{types.Path{"name-lengths", "mariazinha"}, types.TreeFromJSON(`10`)},
+		types.EmittedRow{types.Path{"name-lengths", "mariazinha"}, types.TreeFromJSON(`10.0`)},
 	})
 }
+
+func (s *RunLuaSuite) TestMapGet(c *C) {
+	var requested []types.Path
+	get := func(path types.Path) (types.Tree, error) {
+		requested = append(requested, path)
+		if path.Join() == "customers/maria" {
+			return types.TreeFromJSON(`{"city": "recife"}`), nil
+		}
+		return types.Tree{}, nil
+	}
+
+	order := types.TreeFromJSON(`{"customer": "maria"}`)
+	for _, code := range []string{`
+local customer = get("customers/" .. doc.customer._val)
+emit("by-city", customer.city._val, _key)
+emit("missing", get({"customers", "joão"}) == nil)
+    `, `#!js
+var customer = get("customers/" + doc.customer._val)
+emit("by-city", customer.city._val, _key)
+emit("missing", get(["customers", "joão"]) === null)
+    `} {
+		requested = nil
+		emitted, err := MapGet(context.Background(), code, order, "o1", get)
+		c.Assert(err, IsNil)
+		c.Assert(requested, DeepEquals, []types.Path{{"customers", "maria"}, {"customers", "joão"}})
+		c.Assert(emitted, DeeplyEquals, []types.EmittedRow{
+			types.EmittedRow{types.Path{"by-city", "recife"}, types.TreeFromJSON(`"o1"`)},
+			types.EmittedRow{types.Path{"missing"}, types.TreeFromJSON(`true`)},
+		})
+	}
+
+	// 'get' is only there when a getter is given
+	_, err := Map(`get("customers/maria")`, order, "o1")
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *RunLuaSuite) TestRequire(c *C) {
+	loads := 0
+	env := Env{
+		Require: func(name string) (string, error) {
+			loads++
+			switch name {
+			case "slugify":
+				return `
+local M = {}
+function M.slugify(s) return string.lower(string.gsub(s, "%s+", "-")) end
+return M
+                `, nil
+			}
+			return "", errors.New("library not found: " + name)
+		},
+	}
+
+	emitted, err := MapEnv(context.Background(), `
+local lib = require("slugify")
+emit("slugs", require("slugify").slugify(doc._val), true)
+    `, types.Tree{Leaf: types.StringLeaf("Dia de Sol")}, "x", env)
+	c.Assert(err, IsNil)
+	c.Assert(loads, Equals, 1)
+	c.Assert(emitted[0].RelativePath, DeepEquals, types.Path{"slugs", "dia-de-sol"})
+
+	acc, err := ReduceEnv(context.Background(), `
+acc[require("slugify").slugify(path[1])] = true
+    `, "add", types.Tree{}, types.EmittedRow{RelativePath: types.Path{"A B"}}, "x", env)
+	c.Assert(err, IsNil)
+	c.Assert(acc.Branches["a-b"].Leaf, DeepEquals, types.BoolLeaf(true))
+
+	_, err = MapEnv(context.Background(), `require("nothing")`, types.Tree{}, "x", env)
+	c.Assert(err, ErrorMatches, "(?s).*library not found: nothing.*")
+}
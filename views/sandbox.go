@@ -0,0 +1,365 @@
+package views
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"runtime"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/yuin/gopher-lua"
+)
+
+// Limits bounds the resources a single run of a map or reduce function may use.
+// the memory budget is checked against the growth of the heap since the run
+// started, which is shared by the whole process, so a collection is forced
+// before blaming the run for it. functions that can allocate a lot at once,
+// like string.rep, are checked before they allocate.
+type Limits struct {
+	Timeout       time.Duration // wall-clock budget for a single run
+	Memory        uint64        // heap growth allowed during a single run, in bytes
+	CallStackSize int           // maximum depth of nested calls
+	RegistrySize  int           // maximum size of the lua data stack
+}
+
+// DefaultLimits are applied to every run of Map and Reduce.
+var DefaultLimits = Limits{
+	Timeout:       time.Second * 5,
+	Memory:        64 << 20,
+	CallStackSize: 256,
+	RegistrySize:  1024 * 64,
+}
+
+var (
+	ErrTimeout = errors.New("view function exceeded its time budget")
+	ErrMemory  = errors.New("view function exceeded its memory budget")
+)
+
+// the only libraries user code gets access to. no os, io, package or debug.
+var safeLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// base functions that could load code or touch the filesystem.
+var unsafeBaseFunctions = []string{
+	"dofile", "loadfile", "load", "loadstring", "collectgarbage", "print", "_printregs",
+}
+
+// sandboxes are expensive to create, so they are kept here between runs.
+var sandboxPool sync.Pool
+
+type sandbox struct {
+	L   *lua.LState
+	rng *rand.Rand
+
+	// what the globals (and the tables inside them) looked like
+	// right after setup, so we can restore them between runs.
+	globals    map[lua.LValue]lua.LValue
+	libraries  map[*lua.LTable]map[lua.LValue]lua.LValue
+	metatables map[*lua.LTable]lua.LValue // of the globals and libraries
+	stringmeta map[lua.LValue]lua.LValue  // shared by all strings
+
+	budget *budget // for the current run
+}
+
+// budget holds the context of a single run.
+type budget struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	limit  uint64 // size the heap may reach during the run
+	memory int32  // set when the memory budget is exhausted
+}
+
+// startBudget creates a context for a single run that is cancelled when the
+// time or memory budgets from DefaultLimits are exhausted.
+func startBudget(parent context.Context) *budget {
+	b := &budget{limit: heapBytes() + DefaultLimits.Memory}
+	b.ctx, b.cancel = context.WithTimeout(parent, DefaultLimits.Timeout)
+	go b.watchMemory()
+	return b
+}
+
+// watchMemory checks the heap periodically until the run is over.
+func (b *budget) watchMemory() {
+	ticker := time.NewTicker(time.Millisecond * 5)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.ctx.Done():
+			return
+		case <-ticker.C:
+			if b.exceeds(0) {
+				b.exhaustMemory()
+				return
+			}
+		}
+	}
+}
+
+// exceeds tells if the heap would grow past the memory budget of the run with
+// n more bytes. the heap also holds garbage and what other runs allocate, so
+// it only counts after a collection.
+func (b *budget) exceeds(n uint64) bool {
+	if heapBytes()+n <= b.limit {
+		return false
+	}
+	runtime.GC()
+	return heapBytes()+n > b.limit
+}
+
+// exhaustMemory stops the run, which will fail with ErrMemory.
+func (b *budget) exhaustMemory() {
+	atomic.StoreInt32(&b.memory, 1)
+	b.cancel()
+}
+
+func heapBytes() uint64 {
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	metrics.Read(sample)
+	return sample[0].Value.Uint64()
+}
+
+// the errors raised by lua when its stacks are full.
+var overflowErrors = []string{
+	"stack overflow",
+	"registry overflow",
+	"callstack overflow",
+}
+
+// explain translates an error caused by the cancellation of the run
+// into ErrTimeout or ErrMemory, and the ones caused by full stacks into ErrMemory.
+func (b *budget) explain(err error) error {
+	if atomic.LoadInt32(&b.memory) == 1 {
+		return ErrMemory
+	}
+	if b.ctx.Err() == context.DeadlineExceeded {
+		return ErrTimeout
+	}
+	for _, overflow := range overflowErrors {
+		if strings.Contains(err.Error(), overflow) {
+			return ErrMemory
+		}
+	}
+	return err
+}
+
+// acquireSandbox takes a lua state from the pool (or creates one) and prepares
+// it for a single run: it is bound to a context that is cancelled when the time
+// or memory budgets from DefaultLimits are exhausted, and its random generator
+// is seeded by seed. every acquired sandbox must be released.
+func acquireSandbox(parent context.Context, seed string) *sandbox {
+	s, ok := sandboxPool.Get().(*sandbox)
+	if !ok {
+		s = newSandbox()
+	}
+
+	s.rng.Seed(seedFromString(seed))
+	s.budget = startBudget(parent)
+	s.L.SetContext(s.budget.ctx)
+
+	return s
+}
+
+// releaseSandbox restores the globals touched by the last run and puts the
+// sandbox back in the pool. states that were interrupted are discarded, since
+// they may have been stopped halfway through anything.
+func releaseSandbox(s *sandbox) {
+	interrupted := s.budget.ctx.Err() != nil
+	s.budget.cancel()
+	s.L.RemoveContext()
+	s.budget = nil
+
+	if interrupted {
+		s.L.Close()
+		return
+	}
+	s.restore()
+	sandboxPool.Put(s)
+}
+
+// newSandbox creates a lua state with only the safe libraries loaded and with
+// deterministic replacements for time and random functions.
+func newSandbox() *sandbox {
+	L := lua.NewState(lua.Options{
+		SkipOpenLibs:    true,
+		CallStackSize:   DefaultLimits.CallStackSize,
+		RegistrySize:    1024,
+		RegistryMaxSize: DefaultLimits.RegistrySize,
+	})
+	for _, lib := range safeLibs {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range unsafeBaseFunctions {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	s := &sandbox{L: L, rng: rand.New(rand.NewSource(0))}
+	setDeterministicFunctions(L, s.rng)
+	s.guardAllocations()
+
+	// the 'indexify' function doesn't change between runs
+	L.SetGlobal("indexify", createIndexify(L))
+
+	s.globals = tableSnapshot(L.G.Global)
+	s.libraries = make(map[*lua.LTable]map[lua.LValue]lua.LValue)
+	s.metatables = map[*lua.LTable]lua.LValue{L.G.Global: L.GetMetatable(L.G.Global)}
+	for _, value := range s.globals {
+		if lib, ok := value.(*lua.LTable); ok && lib != L.G.Global {
+			s.libraries[lib] = tableSnapshot(lib)
+			s.metatables[lib] = L.GetMetatable(lib)
+		}
+	}
+	if stringmeta, ok := L.GetMetatable(lua.LString("")).(*lua.LTable); ok {
+		s.stringmeta = tableSnapshot(stringmeta)
+	}
+
+	return s
+}
+
+// guardAllocations makes string.rep check the memory budget before building
+// a string, as a single call can ask for more than the whole budget.
+func (s *sandbox) guardAllocations() {
+	strlib := s.L.GetGlobal("string").(*lua.LTable)
+	rep := strlib.RawGetString("rep").(*lua.LFunction).GFunction
+	strlib.RawSetString("rep", s.L.NewFunction(func(L *lua.LState) int {
+		str, n := L.CheckString(1), L.CheckInt(2)
+		if n > 0 && s.budget.exceeds(uint64(len(str))*uint64(n)) {
+			s.budget.exhaustMemory()
+			L.RaiseError("string.rep: %v", ErrMemory)
+		}
+		return rep(L)
+	}))
+}
+
+// run executes the compiled code in the sandbox, translating budget violations
+// into ErrTimeout and ErrMemory.
+func (s *sandbox) run(code string) error {
+	proto, err := compile(code)
+	if err != nil {
+		return err
+	}
+
+	s.L.Push(s.L.NewFunctionFromProto(proto))
+	err = s.L.PCall(0, lua.MultRet, nil)
+	s.L.SetTop(0)
+	if err == nil {
+		return nil
+	}
+	return s.budget.explain(err)
+}
+
+// restore puts back every global, every library field and their metatables
+// as they were right after the sandbox was created.
+func (s *sandbox) restore() {
+	restoreTable(s.L.G.Global, s.globals)
+	for lib, snapshot := range s.libraries {
+		restoreTable(lib, snapshot)
+	}
+	for table, metatable := range s.metatables {
+		s.L.SetMetatable(table, metatable)
+	}
+	if stringmeta, ok := s.L.GetMetatable(lua.LString("")).(*lua.LTable); ok {
+		restoreTable(stringmeta, s.stringmeta)
+	}
+	s.L.SetTop(0)
+}
+
+func seedFromString(seed string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return int64(h.Sum64())
+}
+
+func tableSnapshot(table *lua.LTable) map[lua.LValue]lua.LValue {
+	snapshot := make(map[lua.LValue]lua.LValue)
+	table.ForEach(func(k lua.LValue, v lua.LValue) {
+		snapshot[k] = v
+	})
+	return snapshot
+}
+
+func restoreTable(table *lua.LTable, snapshot map[lua.LValue]lua.LValue) {
+	var added []lua.LValue
+	table.ForEach(func(k lua.LValue, v lua.LValue) {
+		if _, existed := snapshot[k]; !existed {
+			added = append(added, k)
+		}
+	})
+	for _, k := range added {
+		table.RawSet(k, lua.LNil)
+	}
+	for k, v := range snapshot {
+		if table.RawGet(k) != v {
+			table.RawSet(k, v)
+		}
+	}
+}
+
+// setDeterministicFunctions replaces math.random and math.randomseed with rng
+// and installs an 'os' table whose time functions don't depend on the clock,
+// so all replicas compute the same output.
+func setDeterministicFunctions(L *lua.LState, rng *rand.Rand) {
+	mathlib := L.GetGlobal("math").(*lua.LTable)
+	mathlib.RawSetString("random", L.NewFunction(func(L *lua.LState) int {
+		switch L.GetTop() {
+		case 0:
+			L.Push(lua.LNumber(rng.Float64()))
+		case 1:
+			n := L.CheckInt(1)
+			if n < 1 {
+				L.ArgError(1, "interval is empty")
+			}
+			L.Push(lua.LNumber(rng.Intn(n) + 1))
+		default:
+			m, n := L.CheckInt(1), L.CheckInt(2)
+			if n < m {
+				L.ArgError(2, "interval is empty")
+			}
+			L.Push(lua.LNumber(rng.Intn(n-m+1) + m))
+		}
+		return 1
+	}))
+	mathlib.RawSetString("randomseed", L.NewFunction(func(L *lua.LState) int {
+		rng.Seed(int64(L.CheckNumber(1)))
+		return 0
+	}))
+
+	oslib := L.NewTable()
+	oslib.RawSetString("time", L.NewFunction(func(L *lua.LState) int {
+		// without arguments there is no 'now', only the epoch.
+		if L.GetTop() == 0 {
+			L.Push(lua.LNumber(0))
+			return 1
+		}
+		t := L.CheckTable(1)
+		field := func(name string, def int) int {
+			if v, ok := t.RawGetString(name).(lua.LNumber); ok {
+				return int(v)
+			}
+			return def
+		}
+		date := time.Date(
+			field("year", 1970), time.Month(field("month", 1)), field("day", 1),
+			field("hour", 12), field("min", 0), field("sec", 0), 0, time.UTC)
+		L.Push(lua.LNumber(date.Unix()))
+		return 1
+	}))
+	oslib.RawSetString("clock", L.NewFunction(func(L *lua.LState) int {
+		L.Push(lua.LNumber(0))
+		return 1
+	}))
+	L.SetGlobal("os", oslib)
+}
@@ -0,0 +1,162 @@
+package views
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/summadb/summadb/types"
+	. "gopkg.in/check.v1"
+)
+
+type SandboxSuite struct{}
+
+var _ = Suite(&SandboxSuite{})
+
+func (s *SandboxSuite) TestUnsafeLibrariesAreMissing(c *C) {
+	_, err := Map(`io.write("x")`, types.Tree{}, "")
+	c.Assert(err, Not(IsNil))
+
+	_, err = Map(`os.execute("true")`, types.Tree{}, "")
+	c.Assert(err, Not(IsNil))
+
+	_, err = Map(`dofile("/etc/passwd")`, types.Tree{}, "")
+	c.Assert(err, Not(IsNil))
+
+	_, err = Map(`require("os")`, types.Tree{}, "")
+	c.Assert(err, Not(IsNil))
+}
+
+func (s *SandboxSuite) TestTimeBudget(c *C) {
+	prev := DefaultLimits
+	DefaultLimits.Timeout = time.Millisecond * 100
+	defer func() { DefaultLimits = prev }()
+
+	emitted, err := Map(`
+emit("before", 1)
+while true do end
+    `, types.Tree{}, "")
+	c.Assert(err, Equals, ErrTimeout)
+	c.Assert(emitted, HasLen, 0)
+
+	_, err = Reduce(`while true do end`, "add", types.Tree{}, types.EmittedRow{}, "")
+	c.Assert(err, Equals, ErrTimeout)
+
+	_, err = Map("#!js\nwhile (true) {}", types.Tree{}, "")
+	c.Assert(err, Equals, ErrTimeout)
+}
+
+func (s *SandboxSuite) TestMemoryBudget(c *C) {
+	_, err := Map(`
+local function deeper(n) return 1 + deeper(n + 1) end
+emit("depth", deeper(1))
+    `, types.Tree{}, "")
+	c.Assert(err, Equals, ErrMemory)
+
+	_, err = Map("#!js\nfunction deeper(n) { return 1 + deeper(n + 1) }\nemit('depth', deeper(1))", types.Tree{}, "")
+	c.Assert(err, Equals, ErrMemory)
+
+	prev := DefaultLimits
+	DefaultLimits.Memory = 32 << 20
+	defer func() { DefaultLimits = prev }()
+
+	_, err = Map(`emit("big", string.rep("x", 1e9))`, types.Tree{}, "")
+	c.Assert(err, Equals, ErrMemory)
+
+	_, err = Map(`
+local t = {}
+while true do t[#t + 1] = {#t} end
+    `, types.Tree{}, "")
+	c.Assert(err, Equals, ErrMemory)
+
+	_, err = Map("#!js\nemit('big', 'x'.repeat(1e9))", types.Tree{}, "")
+	c.Assert(err, Equals, ErrMemory)
+
+	_, err = Map("#!js\nvar a = []\nwhile (true) { a.push({n: a.length}) }", types.Tree{}, "")
+	c.Assert(err, Equals, ErrMemory)
+
+	// a run that filled its stacks or its heap doesn't affect the next ones
+	emitted, err := Map(`emit("ok", string.rep("ab", 3))`, types.Tree{}, "")
+	c.Assert(err, IsNil)
+	c.Assert(emitted, HasLen, 1)
+	c.Assert(emitted[0].Value.Leaf, DeepEquals, types.StringLeaf("ababab"))
+
+	emitted, err = Map("#!js\nemit('ok', 'ab'.repeat(3))", types.Tree{}, "")
+	c.Assert(err, IsNil)
+	c.Assert(emitted[0].Value.Leaf, DeepEquals, types.StringLeaf("ababab"))
+}
+
+func (s *SandboxSuite) TestDeterminism(c *C) {
+	code := `
+emit("random", math.random(1000000))
+emit("time", os.time())
+emit("date", os.time({year=2000, month=1, day=1, hour=0}))
+    `
+	first, err := Map(code, types.Tree{}, "some-key")
+	c.Assert(err, IsNil)
+	second, err := Map(code, types.Tree{}, "some-key")
+	c.Assert(err, IsNil)
+	c.Assert(first, DeepEquals, second)
+
+	c.Assert(first[1].RelativePath, DeepEquals, types.Path{"time"})
+	c.Assert(first[1].Value.Leaf, DeepEquals, types.NumberLeaf(0))
+	c.Assert(first[2].Value.Leaf, DeepEquals, types.NumberLeaf(946684800))
+
+	other, err := Map(code, types.Tree{}, "another-key")
+	c.Assert(err, IsNil)
+	c.Assert(other[0], Not(DeepEquals), first[0])
+}
+
+func (s *SandboxSuite) TestStatesAreResetBetweenRuns(c *C) {
+	for i := 0; i < 3; i++ {
+		emitted, err := Map(`
+if leaked ~= nil then emit("leaked", leaked) end
+if string.leaked ~= nil then emit("string-leaked", 1) end
+leaked = "yes"
+string.leaked = true
+emit = nil
+        `, types.Tree{}, "")
+		c.Assert(err, IsNil)
+		c.Assert(emitted, HasLen, 0)
+	}
+
+	// nor metatables
+	for i := 0; i < 3; i++ {
+		emitted, err := Map(`
+if missing ~= nil then emit("leaked", missing) end
+if ("x").leaked ~= nil then emit("string-leaked", 1) end
+setmetatable(_G, {__index = function() return "yes" end})
+setmetatable(math, {__index = function() return "yes" end})
+getmetatable("").__index = function() return "yes" end
+        `, types.Tree{}, "")
+		c.Assert(err, IsNil)
+		c.Assert(emitted, HasLen, 0)
+	}
+
+	// the same code, compiled once, sees each document separately
+	code := `emit("name", doc.name._val)`
+	for _, name := range []string{"maria", "joão"} {
+		emitted, err := Map(code, types.Tree{
+			Branches: types.Branches{"name": &types.Tree{Leaf: types.StringLeaf(name)}},
+		}, name)
+		c.Assert(err, IsNil)
+		c.Assert(emitted, HasLen, 1)
+		c.Assert(emitted[0].Value.Leaf, DeepEquals, types.StringLeaf(name))
+	}
+}
+
+func (s *SandboxSuite) TestCompiledCacheIsBounded(c *C) {
+	prev := CompiledCacheSize
+	CompiledCacheSize = 4
+	defer func() { CompiledCacheSize = prev }()
+
+	for i := 0; i < 10; i++ {
+		_, err := Map(fmt.Sprintf(`emit("n", %d)`, i), types.Tree{}, "")
+		c.Assert(err, IsNil)
+	}
+	c.Assert(protoCache.len(), Equals, 4)
+
+	// the most recently used ones are kept
+	_, err := Map(`emit("n", 9)`, types.Tree{}, "")
+	c.Assert(err, IsNil)
+	c.Assert(protoCache.len(), Equals, 4)
+}